@@ -0,0 +1,255 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// accessKeysParam is the machine param holding the ssh keys installed on the machine
+const accessKeysParam = "access-keys"
+
+/*
+ * Returns the access-keys name for an ssh public key.  The name is
+ * derived from the key fingerprint so it does not depend on the order of
+ * authorized_keys.
+ */
+func accessKeyName(key string) (string, error) {
+	fp, err := keyFingerprint(key)
+	if err != nil {
+		return "", err
+	}
+	return "terraform-" + fp, nil
+}
+
+/*
+ * Returns the SHA256 fingerprint of an ssh public key in the format
+ * printed by ssh-keygen -l.
+ */
+func keyFingerprint(key string) (string, error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("expected \"<type> <base64 key> [comment]\"")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("key is not base64 encoded: %w", err)
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+/*
+ * Returns the access-keys names for the ssh public keys.
+ */
+func accessKeyNames(keys []string) (map[string]string, error) {
+	named := map[string]string{}
+	for _, key := range keys {
+		name, err := accessKeyName(key)
+		if err != nil {
+			return nil, err
+		}
+		named[name] = strings.TrimSpace(key)
+	}
+	return named, nil
+}
+
+/*
+ * Fetches the access-keys param of the machine.
+ */
+func (r *MachineResource) getAccessKeys(ctx context.Context, uuid string) (map[string]string, error) {
+	keys := map[string]string{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines", uuid, "params", accessKeysParam).Do(&keys); err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if keys == nil {
+		keys = map[string]string{}
+	}
+	return keys, nil
+}
+
+/*
+ * Sets the access-keys param of the machine, removing it when no keys
+ * are left.
+ */
+func (r *MachineResource) setAccessKeys(ctx context.Context, uuid string, keys map[string]string) error {
+	if len(keys) == 0 {
+		var res interface{}
+		err := r.session.Req().Context(ctx).Del().UrlFor("machines", uuid, "params", accessKeysParam).Do(&res)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	res := map[string]string{}
+	return r.session.Req().Context(ctx).Post(keys).UrlFor("machines", uuid, "params", accessKeysParam).Do(&res)
+}
+
+/*
+ * Merges the ssh public keys into the access-keys param of the machine.
+ * Keys the machine already had are left alone, the names of the keys
+ * that were added are recorded in the changes.
+ */
+func (r *MachineResource) addAccessKeys(ctx context.Context, uuid string, keys []string, changes *machineChanges) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	named, err := accessKeyNames(keys)
+	if err != nil {
+		return err
+	}
+	current, err := r.getAccessKeys(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	added := []string{}
+	for name, key := range named {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		current[name] = key
+		added = append(added, name)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	tflog.Debug(ctx, fmt.Sprintf("Adding %d access keys to machine %s", len(added), uuid))
+	if err := r.setAccessKeys(ctx, uuid, current); err != nil {
+		return err
+	}
+	if changes != nil {
+		changes.AccessKeys = append(changes.AccessKeys, added...)
+	}
+	return nil
+}
+
+/*
+ * Removes the access-keys entries selected by match from the machine.
+ */
+func (r *MachineResource) removeAccessKeys(ctx context.Context, uuid string, match func(name, key string) bool) error {
+	current, err := r.getAccessKeys(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for name, key := range current {
+		if match(name, key) {
+			delete(current, name)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	tflog.Debug(ctx, fmt.Sprintf("Removing %d access keys from machine %s", removed, uuid))
+	return r.setAccessKeys(ctx, uuid, current)
+}
+
+/*
+ * Removes the given ssh public keys from the machine.  With recorded
+ * changes only the keys Terraform added are removed, otherwise keys are
+ * matched by value.
+ */
+func (r *MachineResource) dropAccessKeys(ctx context.Context, uuid string, keys []string, changes *machineChanges) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if changes == nil || changes.Untracked {
+		values := map[string]bool{}
+		for _, key := range keys {
+			values[strings.TrimSpace(key)] = true
+		}
+		return r.removeAccessKeys(ctx, uuid, func(name, key string) bool {
+			return values[strings.TrimSpace(key)]
+		})
+	}
+	named, err := accessKeyNames(keys)
+	if err != nil {
+		return err
+	}
+	ours := map[string]bool{}
+	kept := []string{}
+	for _, name := range changes.AccessKeys {
+		if _, ok := named[name]; ok {
+			ours[name] = true
+		} else {
+			kept = append(kept, name)
+		}
+	}
+	if err := r.removeAccessKeys(ctx, uuid, func(name, key string) bool { return ours[name] }); err != nil {
+		return err
+	}
+	changes.AccessKeys = kept
+	return nil
+}
+
+/*
+ * Removes the authorized_keys of the plan from the machine before it is
+ * released.
+ */
+func (r *MachineResource) undoAccessKeys(ctx context.Context, plan *MachineResourceModel, uuid string, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	akeys := []string{}
+	diags.Append(plan.AuthorizedKeys.ElementsAs(ctx, &akeys, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	if err := r.dropAccessKeys(ctx, uuid, akeys, changes); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to remove authorized_keys from machine %s", uuid), err.Error())
+	}
+	return diags
+}
+
+/*
+ * Applies changes to authorized_keys in place and records the new keys
+ * in the allocation record so an import restores them.
+ */
+func (r *MachineResource) updateAccessKeys(ctx context.Context, plan, state *MachineResourceModel, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	uuid := state.Id.ValueString()
+	planKeys, stateKeys := []string{}, []string{}
+	diags.Append(plan.AuthorizedKeys.ElementsAs(ctx, &planKeys, false)...)
+	diags.Append(state.AuthorizedKeys.ElementsAs(ctx, &stateKeys, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	planNamed, err := accessKeyNames(planKeys)
+	if err == nil {
+		_, err = accessKeyNames(stateKeys)
+	}
+	if err != nil {
+		diags.AddError("Unable to parse authorized_keys", err.Error())
+		return diags
+	}
+
+	removed := []string{}
+	for _, key := range stateKeys {
+		name, _ := accessKeyName(key)
+		if _, ok := planNamed[name]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	if err := r.dropAccessKeys(ctx, uuid, removed, changes); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to remove authorized_keys from machine %s", uuid), err.Error())
+		return diags
+	}
+	if err := r.addAccessKeys(ctx, uuid, planKeys, changes); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to add authorized_keys to machine %s", uuid), err.Error())
+		return diags
+	}
+	if err := r.updateRecord(ctx, uuid, func(rec *allocationRecord) { rec.AuthorizedKeys = planKeys }); err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("Failed to record the authorized_keys of machine %s: %v", uuid, err))
+	}
+	return diags
+}
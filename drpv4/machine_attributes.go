@@ -0,0 +1,219 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// MachineInterfaceModel describes a network interface of the machine.
+type MachineInterfaceModel struct {
+	Name types.String `tfsdk:"name"`
+	Mac  types.String `tfsdk:"mac"`
+	IPv4 types.List   `tfsdk:"ipv4"`
+	IPv6 types.List   `tfsdk:"ipv6"`
+}
+
+var machineInterfaceType = types.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"name": types.StringType,
+		"mac":  types.StringType,
+		"ipv4": types.ListType{ElemType: types.StringType},
+		"ipv6": types.ListType{ElemType: types.StringType},
+	},
+}
+
+// gohaiInterface is the subset of the gohai-inventory interface data used by the provider
+type gohaiInterface struct {
+	Name         string
+	HardwareAddr string
+	Addrs        []string
+}
+
+type gohaiInventory struct {
+	Networking struct {
+		Interfaces map[string]gohaiInterface
+	}
+}
+
+/*
+ * Decodes the network interfaces from a gohai-inventory param value,
+ * sorted by name.  A value that cannot be decoded is reported as a
+ * warning and yields no interfaces.
+ */
+func gohaiInterfaces(ctx context.Context, inv interface{}) ([]MachineInterfaceModel, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	var d diag.Diagnostics
+
+	interfaces := []MachineInterfaceModel{}
+	gi := &gohaiInventory{}
+	if err := models.Remarshal(inv, gi); err != nil {
+		diags.AddWarning("Unable to decode the gohai-inventory param", fmt.Sprintf("The interfaces attribute is left empty: %v", err))
+		return interfaces, diags
+	}
+	names := []string{}
+	for name := range gi.Networking.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		intf := gi.Networking.Interfaces[name]
+		ipv4, ipv6 := []string{}, []string{}
+		for _, addr := range intf.Addrs {
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil {
+				tflog.Debug(ctx, fmt.Sprintf("Ignoring address %q of interface %s: %v", addr, name, err))
+				continue
+			}
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip.String())
+			} else {
+				ipv6 = append(ipv6, ip.String())
+			}
+		}
+		im := MachineInterfaceModel{
+			Name: types.StringValue(name),
+			Mac:  types.StringValue(intf.HardwareAddr),
+		}
+		im.IPv4, d = types.ListValueFrom(ctx, types.StringType, ipv4)
+		diags.Append(d...)
+		im.IPv6, d = types.ListValueFrom(ctx, types.StringType, ipv6)
+		diags.Append(d...)
+		interfaces = append(interfaces, im)
+	}
+	return interfaces, diags
+}
+
+/*
+ * Fills the computed attributes of the model from the machine object.
+ */
+func (r *MachineResource) setMachineAttributes(ctx context.Context, plan *MachineResourceModel, machine *models.Machine) diag.Diagnostics {
+	var diags diag.Diagnostics
+	var d diag.Diagnostics
+
+	uuid := machine.Uuid.String()
+	plan.Status = types.StringValue(string(machine.PoolStatus))
+	plan.Name = types.StringValue(machine.Name)
+	plan.Id = types.StringValue(uuid)
+	plan.Address = types.StringValue(machine.Address.String())
+	plan.Arch = types.StringValue(machine.Arch)
+	plan.BootEnv = types.StringValue(machine.BootEnv)
+	plan.Workflow = types.StringValue(machine.Workflow)
+	plan.Stage = types.StringValue(machine.Stage)
+	currentTask := ""
+	if machine.CurrentTask >= 0 && machine.CurrentTask < len(machine.Tasks) {
+		currentTask = machine.Tasks[machine.CurrentTask]
+	}
+	plan.CurrentTask = types.StringValue(currentTask)
+
+	plan.HardwareAddrs, d = types.ListValueFrom(ctx, types.StringType, machine.HardwareAddrs)
+	diags.Append(d...)
+	plan.Profiles, d = types.ListValueFrom(ctx, types.StringType, machine.Profiles)
+	diags.Append(d...)
+	meta := map[string]string{}
+	for k, v := range machine.Meta {
+		meta[k] = v
+	}
+	plan.MachineMeta, d = types.MapValueFrom(ctx, types.StringType, meta)
+	diags.Append(d...)
+
+	interfaces := []MachineInterfaceModel{}
+	if inv, ok := machine.Params["gohai-inventory"]; ok {
+		interfaces, d = gohaiInterfaces(ctx, inv)
+		diags.Append(d...)
+	}
+	plan.Interfaces, d = types.ListValueFrom(ctx, machineInterfaceType, interfaces)
+	diags.Append(d...)
+
+	readParams := []string{}
+	diags.Append(plan.ReadParameters.ElementsAs(ctx, &readParams, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	params := map[string]string{}
+	for _, name := range readParams {
+		val, err := r.readParam(ctx, uuid, name)
+		if err != nil {
+			tflog.Warn(ctx, fmt.Sprintf("Failed to read param %s on machine %s: %v", name, uuid, err))
+			continue
+		}
+		if val == nil {
+			continue
+		}
+		if s, ok := val.(string); ok {
+			params[name] = s
+			continue
+		}
+		buf, err := json.Marshal(val)
+		if err != nil {
+			diags.AddError(fmt.Sprintf("Unable to encode param %s on machine %s", name, uuid), err.Error())
+			continue
+		}
+		params[name] = string(buf)
+	}
+	plan.Parameters, d = types.MapValueFrom(ctx, types.StringType, params)
+	diags.Append(d...)
+
+	plan.ConnectionInfo, d = r.connectionInfo(ctx, plan, machine)
+	diags.Append(d...)
+
+	if power, err := r.powerStatus(ctx, uuid); err == nil {
+		plan.PowerState = types.StringValue(power)
+	} else {
+		tflog.Debug(ctx, fmt.Sprintf("Failed to get the power state of machine %s: %v", uuid, err))
+	}
+
+	return diags
+}
+
+/*
+ * Reads a param of the machine, including values set through profiles.
+ */
+func (r *MachineResource) readParam(ctx context.Context, uuid, name string) (interface{}, error) {
+	var val interface{}
+	err := r.session.Req().Context(ctx).UrlFor("machines", uuid, "params", name).Params("aggregate", "true").Do(&val)
+	return val, err
+}
+
+/*
+ * Sets computed machine attributes that are still unknown to null so the
+ * model can be saved when the machine could not be looked up.
+ */
+func clearMachineAttributes(plan *MachineResourceModel) {
+	for _, s := range []*types.String{&plan.Address, &plan.Arch, &plan.BootEnv, &plan.Workflow, &plan.Stage, &plan.CurrentTask, &plan.PowerState} {
+		if s.IsUnknown() {
+			*s = types.StringNull()
+		}
+	}
+	for _, l := range []*types.List{&plan.HardwareAddrs, &plan.Profiles} {
+		if l.IsUnknown() {
+			*l = types.ListNull(types.StringType)
+		}
+	}
+	if plan.Interfaces.IsUnknown() {
+		plan.Interfaces = types.ListNull(machineInterfaceType)
+	}
+	if plan.ConnectionInfo.IsUnknown() {
+		plan.ConnectionInfo = types.ObjectNull(connectionInfoType.AttrTypes)
+	}
+	if plan.WorkOrderResults.IsUnknown() {
+		plan.WorkOrderResults = types.ListNull(workOrderResultType)
+	}
+	for _, m := range []*types.Map{&plan.MachineMeta, &plan.Parameters} {
+		if m.IsUnknown() {
+			*m = types.MapNull(types.StringType)
+		}
+	}
+}
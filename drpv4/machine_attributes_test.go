@@ -0,0 +1,63 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGohaiInterfaces(t *testing.T) {
+	ctx := context.Background()
+	raw, err := os.ReadFile("testdata/gohai-inventory.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Param values are decoded as generic JSON before they reach the provider.
+	var inv interface{}
+	if err := json.Unmarshal(raw, &inv); err != nil {
+		t.Fatal(err)
+	}
+	interfaces, diags := gohaiInterfaces(ctx, inv)
+	if diags.HasError() || diags.WarningsCount() > 0 {
+		t.Fatalf("decode: %v", diags)
+	}
+
+	want := []struct {
+		name, mac  string
+		ipv4, ipv6 []string
+	}{
+		{"ens3", "52:54:00:8a:4d:21", []string{"192.168.124.21"}, []string{"fe80::5054:ff:fe8a:4d21"}},
+		{"ens4", "52:54:00:1c:9e:02", []string{}, []string{}},
+		{"lo", "", []string{"127.0.0.1"}, []string{"::1"}},
+	}
+	if len(interfaces) != len(want) {
+		t.Fatalf("got %d interfaces, want %d", len(interfaces), len(want))
+	}
+	for i, w := range want {
+		got := interfaces[i]
+		ipv4, ipv6 := []string{}, []string{}
+		got.IPv4.ElementsAs(ctx, &ipv4, false)
+		got.IPv6.ElementsAs(ctx, &ipv6, false)
+		if got.Name.ValueString() != w.name || got.Mac.ValueString() != w.mac ||
+			!reflect.DeepEqual(ipv4, w.ipv4) || !reflect.DeepEqual(ipv6, w.ipv6) {
+			t.Errorf("interface %d = %s %s %v %v, want %s %s %v %v",
+				i, got.Name, got.Mac, ipv4, ipv6, w.name, w.mac, w.ipv4, w.ipv6)
+		}
+	}
+}
+
+func TestGohaiInterfacesUnexpectedShape(t *testing.T) {
+	inv := map[string]interface{}{
+		"Networking": map[string]interface{}{"Interfaces": []interface{}{"ens3"}},
+	}
+	interfaces, diags := gohaiInterfaces(context.Background(), inv)
+	if len(interfaces) != 0 || diags.WarningsCount() != 1 {
+		t.Fatalf("expected no interfaces and a warning, got %d interfaces and %v", len(interfaces), diags)
+	}
+}
@@ -0,0 +1,145 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/api"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// defaultAvailabilityTimeout bounds the wait for a free machine when availability_timeout is not set
+const defaultAvailabilityTimeout = 30 * time.Minute
+
+// Allocation errors: the pool allocated nothing, or the placement group could not be spread
+var (
+	errNoMachine = errors.New("no machine was allocated")
+	errPlacement = errors.New("unable to spread placement group")
+)
+
+/*
+ * Counts the free machines in the pool that match the allocation filters.
+ */
+func (r *MachineResource) countAvailable(ctx context.Context, pool string, filters []string) (int, error) {
+	params := []string{"Pool", pool, "PoolStatus", "Free"}
+	for _, f := range filters {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		params = append(params, parts[0], parts[1])
+	}
+	machines := []*models.Machine{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines").Params(params...).Do(&machines); err != nil {
+		return 0, err
+	}
+	return len(machines), nil
+}
+
+/*
+ * Returns the filters matching the free machines the allocation can use,
+ * including the pinned machine.
+ */
+func availabilityFilters(parms map[string]interface{}) []string {
+	filters, _ := parms["pool/filter"].([]string)
+	if pinned, ok := parms["pool/machine-list"].([]string); ok && len(pinned) == 1 {
+		filters = append(append([]string{}, filters...), fmt.Sprintf("Uuid=Eq(%s)", pinned[0]))
+	}
+	return filters
+}
+
+/*
+ * Reports if an allocation failed because no matching machine was free,
+ * e.g. nothing matched or the pinned machine is busy.  Other failures,
+ * such as permission errors or a free machine the pool refused, are not
+ * worth waiting on.
+ */
+func (r *MachineResource) unavailable(ctx context.Context, pool string, parms map[string]interface{}, err error) bool {
+	if errors.Is(err, errNoMachine) {
+		return true
+	}
+	if errors.Is(err, errPlacement) {
+		return false
+	}
+	var me *models.Error
+	if errors.As(err, &me) && (me.Code == http.StatusUnauthorized || me.Code == http.StatusForbidden) {
+		return false
+	}
+	count, cerr := r.countAvailable(ctx, pool, availabilityFilters(parms))
+	return cerr == nil && count == 0
+}
+
+/*
+ * Waits until a machine matching the filters is free in the pool and
+ * allocates it.  Machine events from the endpoint wake the wait early;
+ * without them the pool is polled.  Each allocation attempt gets the
+ * full create timeout, the wait itself is bounded by availability_timeout.
+ */
+func (r *MachineResource) allocateWhenAvailable(ctx context.Context, plan *MachineResourceModel, pool string, parms map[string]interface{}) (*models.PoolResult, error) {
+	availability := defaultAvailabilityTimeout
+	if d, err := time.ParseDuration(plan.AvailabilityTimeout.ValueString()); err == nil {
+		availability = d
+	}
+	wctx, cancel := context.WithTimeout(ctx, availability)
+	defer cancel()
+
+	var events <-chan api.RecievedEvent
+	if es, err := r.session.Events(); err == nil {
+		defer es.Close()
+		if handle, ch, err := es.Register("machines.*.*"); err == nil {
+			defer es.Deregister(handle)
+			events = ch
+		}
+	} else {
+		tflog.Debug(ctx, fmt.Sprintf("Unable to watch machine events, polling pool %s: %v", pool, err))
+	}
+
+	filters := availabilityFilters(parms)
+	var lastErr error
+	for {
+		count, err := r.countAvailable(wctx, pool, filters)
+		if err != nil && wctx.Err() == nil {
+			return nil, err
+		}
+		if count > 0 {
+			actx, acancel := context.WithTimeout(ctx, plan.operationTimeout("create"))
+			parms["pool/wait-timeout"] = waitTimeout(actx)
+			mc, err := r.allocate(actx, plan, pool, parms)
+			acancel()
+			if err == nil {
+				return mc, nil
+			}
+			if ctx.Err() != nil || !r.unavailable(wctx, pool, parms, err) {
+				return nil, err
+			}
+			// Another allocation claimed the machine first, keep waiting.
+			lastErr = err
+			tflog.Info(ctx, fmt.Sprintf("Allocation from pool %s lost a race, waiting again: %v", pool, err))
+		}
+
+		tflog.Info(ctx, fmt.Sprintf("Waiting for a free machine in pool %s", pool))
+		select {
+		case <-wctx.Done():
+			if lastErr != nil {
+				return nil, fmt.Errorf("no matching machine became free in pool %s within %s, last allocation error: %w", pool, availability, lastErr)
+			}
+			return nil, fmt.Errorf("no matching machine became free in pool %s within %s", pool, availability)
+		case _, ok := <-events:
+			if !ok {
+				// The event stream dropped, fall back to polling.
+				tflog.Debug(ctx, fmt.Sprintf("Machine events closed, polling pool %s", pool))
+				events = nil
+			}
+		case <-time.After(pollInterval):
+		}
+	}
+}
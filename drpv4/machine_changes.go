@@ -0,0 +1,263 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// changesKey is the private state key recording what was changed on the machine
+const changesKey = "machine_changes"
+
+// paramChange records a param set on the machine and the value it replaced
+type paramChange struct {
+	Name     string      `json:"name"`
+	Replaced bool        `json:"replaced"`
+	Previous interface{} `json:"previous,omitempty"`
+}
+
+// machineChanges records the params, profiles, access keys and labels changed on an allocated machine
+type machineChanges struct {
+	Params      []paramChange `json:"params"`
+	Profiles    []string      `json:"profiles"`
+	AccessKeys  []string      `json:"access_keys,omitempty"`
+	Name        *string       `json:"name,omitempty"`
+	Description *string       `json:"description,omitempty"`
+	Meta        []paramChange `json:"meta,omitempty"`
+	// WorkOrderMode is the mode of the machine before work orders were run
+	WorkOrderMode *bool `json:"work_order_mode,omitempty"`
+	// Untracked is set on import, the params, profiles and access keys added on allocation are unknown
+	Untracked bool `json:"untracked,omitempty"`
+}
+
+// privateGetter and privateSetter are satisfied by the framework private state
+type privateGetter interface {
+	GetKey(ctx context.Context, key string) ([]byte, diag.Diagnostics)
+}
+
+type privateSetter interface {
+	SetKey(ctx context.Context, key string, value []byte) diag.Diagnostics
+}
+
+/*
+ * Returns the params and profiles the plan adds to the machine.
+ */
+func additions(ctx context.Context, plan *MachineResourceModel) (map[string]interface{}, []string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	profiles := []string{}
+	diags.Append(plan.AddProfiles.ElementsAs(ctx, &profiles, false)...)
+	if diags.HasError() {
+		return nil, nil, diags
+	}
+
+	parameters := map[string]interface{}{}
+	aparams := []string{}
+	diags.Append(plan.AddParameters.ElementsAs(ctx, &aparams, false)...)
+	if diags.HasError() {
+		return nil, nil, diags
+	}
+	for _, p := range aparams {
+		param := strings.Split(p, ":")
+		if len(param) < 2 {
+			diags.AddError("add_parameter format not correct", p)
+			return nil, nil, diags
+		}
+		key := param[0]
+		value := strings.TrimLeft(param[1], " ")
+		parameters[key] = value
+	}
+	return parameters, profiles, diags
+}
+
+/*
+ * Returns the secure params the plan adds to the machine, unencrypted.
+ */
+func secureAdditions(ctx context.Context, plan *MachineResourceModel) (map[string]string, diag.Diagnostics) {
+	secure := map[string]string{}
+	diags := plan.SecureParameters.ElementsAs(ctx, &secure, false)
+	return secure, diags
+}
+
+/*
+ * Adds the params, profiles, access keys and labels from the plan to an allocated machine,
+ * recording each change and any value it replaced.  Changes made before
+ * an error are still recorded so they can be undone on release.
+ */
+func (r *MachineResource) applyChanges(ctx context.Context, plan *MachineResourceModel, uuid string, changes *machineChanges) diag.Diagnostics {
+	parameters, profiles, diags := additions(ctx, plan)
+	if diags.HasError() {
+		return diags
+	}
+
+	secure, sdiags := secureAdditions(ctx, plan)
+	diags.Append(sdiags...)
+	if diags.HasError() {
+		return diags
+	}
+	encrypted, err := r.encryptParams(ctx, uuid, secure)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to set secure_parameters on machine %s", uuid), err.Error())
+		return diags
+	}
+	for name, value := range encrypted {
+		parameters[name] = value
+	}
+
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return diags
+	}
+
+	names := []string{}
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		previous, replaced := machine.Params[name]
+		var res interface{}
+		if err := r.session.Req().Context(ctx).Post(parameters[name]).UrlFor("machines", uuid, "params", name).Do(&res); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to set param %s on machine %s", name, uuid), err.Error())
+			return diags
+		}
+		tflog.Debug(ctx, fmt.Sprintf("Set param %s on machine %s (replaced: %v)", name, uuid, replaced))
+		changes.Params = append(changes.Params, paramChange{Name: name, Replaced: replaced, Previous: previous})
+	}
+
+	akeys := []string{}
+	diags.Append(plan.AuthorizedKeys.ElementsAs(ctx, &akeys, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	if err := r.addAccessKeys(ctx, uuid, akeys, changes); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to add authorized_keys to machine %s", uuid), err.Error())
+		return diags
+	}
+	diags.Append(r.updateLabels(ctx, plan, nil, uuid, changes)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	added := []string{}
+	for _, profile := range profiles {
+		found := false
+		for _, p := range machine.Profiles {
+			if p == profile {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, profile)
+		}
+	}
+	if len(added) > 0 {
+		// Params were set through their own API calls, so patch a fresh copy.
+		machine, err = r.getMachine(ctx, uuid)
+		if err != nil {
+			diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+			return diags
+		}
+		updated := models.Clone(machine).(*models.Machine)
+		updated.Profiles = append(updated.Profiles, added...)
+		if err := r.patchMachine(ctx, machine, updated); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to add profiles to machine %s", uuid), err.Error())
+			return diags
+		}
+		changes.Profiles = append(changes.Profiles, added...)
+	}
+	return diags
+}
+
+/*
+ * Adds the release parameters that undo the recorded changes: params
+ * the provider created are removed, replaced values are restored and
+ * only the profiles the provider added are removed.
+ */
+func (c *machineChanges) releaseParms(parms map[string]interface{}, remove []string, restore map[string]interface{}) {
+	for _, p := range c.Params {
+		if _, ok := restore[p.Name]; ok {
+			continue
+		}
+		if p.Replaced {
+			restore[p.Name] = p.Previous
+		} else {
+			remove = append(remove, p.Name)
+		}
+	}
+	parms["pool/remove-parameters"] = remove
+	if len(restore) > 0 {
+		parms["pool/add-parameters"] = restore
+	}
+	if len(c.Profiles) > 0 {
+		parms["pool/remove-profiles"] = c.Profiles
+	}
+}
+
+/*
+ * Returns the recorded change of a param.
+ */
+func (c *machineChanges) paramChange(name string) *paramChange {
+	for i := range c.Params {
+		if c.Params[i].Name == name {
+			return &c.Params[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * Forgets the recorded change of a param.
+ */
+func (c *machineChanges) dropParamChange(name string) {
+	kept := c.Params[:0]
+	for _, p := range c.Params {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	c.Params = kept
+}
+
+/*
+ * Records the changes in the private state of the resource.
+ */
+func saveChanges(ctx context.Context, private privateSetter, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+	buf, err := json.Marshal(changes)
+	if err != nil {
+		diags.AddError("Unable to encode the machine changes", err.Error())
+		return diags
+	}
+	return private.SetKey(ctx, changesKey, buf)
+}
+
+/*
+ * Loads the changes from the private state of the resource.  Returns nil
+ * when nothing was recorded, e.g. for state written by older versions of
+ * the provider.
+ */
+func loadChanges(ctx context.Context, private privateGetter) (*machineChanges, diag.Diagnostics) {
+	buf, diags := private.GetKey(ctx, changesKey)
+	if diags.HasError() || len(buf) == 0 {
+		return nil, diags
+	}
+	changes := &machineChanges{}
+	if err := json.Unmarshal(buf, changes); err != nil {
+		diags.AddError("Unable to decode the machine changes", err.Error())
+		return nil, diags
+	}
+	return changes, diags
+}
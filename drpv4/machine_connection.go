@@ -0,0 +1,178 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// connection_params defaults
+const (
+	defaultConnectionUserParam = "provisioner-default-user"
+	defaultConnectionUser      = "root"
+	defaultConnectionPort      = 22
+)
+
+// ConnectionParamsModel names the machine params connection_info is read from.
+type ConnectionParamsModel struct {
+	User    types.String `tfsdk:"user"`
+	Port    types.String `tfsdk:"port"`
+	Bastion types.String `tfsdk:"bastion"`
+	HostKey types.String `tfsdk:"host_key"`
+}
+
+// ConnectionInfoModel describes how to connect to the machine.
+type ConnectionInfoModel struct {
+	Host               types.String `tfsdk:"host"`
+	Port               types.Int64  `tfsdk:"port"`
+	User               types.String `tfsdk:"user"`
+	Bastion            types.String `tfsdk:"bastion"`
+	HostKeyFingerprint types.String `tfsdk:"host_key_fingerprint"`
+}
+
+var connectionInfoType = types.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"host":                 types.StringType,
+		"port":                 types.Int64Type,
+		"user":                 types.StringType,
+		"bastion":              types.StringType,
+		"host_key_fingerprint": types.StringType,
+	},
+}
+
+/*
+ * Builds the connection_params { user, port, bastion, host_key } block.
+ */
+func connectionParamsBlock() schema.Block {
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "Machine params connection_info is read from.",
+		Attributes: map[string]schema.Attribute{
+			"user": schema.StringAttribute{
+				MarkdownDescription: "Param holding the login user.  Defaults to `provisioner-default-user`, the user is `root` when the param is not set.",
+				Optional:            true,
+			},
+			"port": schema.StringAttribute{
+				MarkdownDescription: "Param holding the ssh port.  The port is 22 when not set.",
+				Optional:            true,
+			},
+			"bastion": schema.StringAttribute{
+				MarkdownDescription: "Param holding the bastion host used to reach the machine.",
+				Optional:            true,
+			},
+			"host_key": schema.StringAttribute{
+				MarkdownDescription: "Param holding the ssh host public key or its fingerprint.",
+				Optional:            true,
+			},
+		},
+	}
+}
+
+/*
+ * Builds the connection_info attribute.
+ */
+func connectionInfoAttribute() schema.Attribute {
+	return schema.SingleNestedAttribute{
+		Computed:            true,
+		MarkdownDescription: "Returns how to connect to the machine, for connection blocks and inventories.  Values other than host are read from the params named in connection_params.",
+		Attributes: map[string]schema.Attribute{
+			"host": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Primary address of the machine",
+			},
+			"port": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "ssh port of the machine",
+			},
+			"user": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "User to log in as",
+			},
+			"bastion": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Bastion host used to reach the machine, null when not set",
+			},
+			"host_key_fingerprint": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "SHA256 fingerprint of the ssh host key, null when not set",
+			},
+		},
+	}
+}
+
+/*
+ * Returns the SHA256 fingerprint of an ssh host key.  Values that are not
+ * public keys are assumed to be fingerprints already.
+ */
+func hostKeyFingerprint(value string) string {
+	value = strings.TrimSpace(value)
+	if fp, err := keyFingerprint(value); err == nil {
+		return fp
+	}
+	return value
+}
+
+/*
+ * Reads connection_info from the machine.
+ */
+func (r *MachineResource) connectionInfo(ctx context.Context, plan *MachineResourceModel, machine *models.Machine) (types.Object, diag.Diagnostics) {
+	uuid := machine.Uuid.String()
+	names := ConnectionParamsModel{}
+	if plan.ConnectionParams != nil {
+		names = *plan.ConnectionParams
+	}
+	read := func(name types.String, def string) string {
+		param := def
+		if !name.IsNull() && !name.IsUnknown() {
+			param = name.ValueString()
+		}
+		if param == "" {
+			return ""
+		}
+		val, err := r.readParam(ctx, uuid, param)
+		if err != nil {
+			tflog.Warn(ctx, fmt.Sprintf("Failed to read param %s on machine %s: %v", param, uuid, err))
+			return ""
+		}
+		if val == nil {
+			return ""
+		}
+		return fmt.Sprint(val)
+	}
+
+	info := ConnectionInfoModel{
+		Host:               types.StringValue(machine.Address.String()),
+		Port:               types.Int64Value(defaultConnectionPort),
+		User:               types.StringValue(defaultConnectionUser),
+		Bastion:            types.StringNull(),
+		HostKeyFingerprint: types.StringNull(),
+	}
+	if user := read(names.User, defaultConnectionUserParam); user != "" {
+		info.User = types.StringValue(user)
+	}
+	if port := read(names.Port, ""); port != "" {
+		if p, err := strconv.ParseInt(port, 10, 64); err == nil {
+			info.Port = types.Int64Value(p)
+		} else {
+			tflog.Warn(ctx, fmt.Sprintf("Ignoring ssh port %q of machine %s: %v", port, uuid, err))
+		}
+	}
+	if bastion := read(names.Bastion, ""); bastion != "" {
+		info.Bastion = types.StringValue(bastion)
+	}
+	if key := read(names.HostKey, ""); key != "" {
+		info.HostKeyFingerprint = types.StringValue(hostKeyFingerprint(key))
+	}
+	return types.ObjectValueFrom(ctx, connectionInfoType.AttrTypes, info)
+}
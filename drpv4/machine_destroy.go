@@ -0,0 +1,57 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// on_destroy modes for releasing a machine
+const (
+	onDestroyRelease    = "release"
+	onDestroyWipe       = "wipe"
+	onDestroyDeregister = "deregister"
+	onDestroyRetain     = "retain"
+)
+
+/*
+ * Runs the wipe workflow on the machine and waits for it to finish.  The
+ * machine must not be released unless this succeeds.
+ */
+func (r *MachineResource) wipeMachine(ctx context.Context, machine *models.Machine, workflow string) error {
+	uuid := machine.Uuid.String()
+	if workflow == "" {
+		return fmt.Errorf("no wipe_workflow is set for machine %s", uuid)
+	}
+	tflog.Info(ctx, fmt.Sprintf("Wiping machine %s with workflow %s", uuid, workflow))
+	if err := r.startWorkflow(ctx, machine, workflow, ""); err != nil {
+		return err
+	}
+	wiped, err := r.waitForWorkflow(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if !wiped.Runnable {
+		return fmt.Errorf("workflow %s failed on machine %s", workflow, uuid)
+	}
+	return nil
+}
+
+/*
+ * Deletes the machine object from DRP.
+ */
+func (r *MachineResource) deregisterMachine(ctx context.Context, uuid string) error {
+	tflog.Info(ctx, fmt.Sprintf("Deleting machine %s", uuid))
+	res := &models.Machine{}
+	err := r.session.Req().Context(ctx).Del().UrlFor("machines", uuid).Do(res)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// defaultFilters restrict allocation to idle machines unless default_filters overrides them
+var defaultFilters = []string{"Runnable=Eq(true)", "WorkflowComplete=Eq(true)", "WorkOrderMode=Eq(false)"}
+
+// filterOps are the DRP filter operators accepted in filter blocks
+var filterOps = []string{"Eq", "Ne", "Lt", "Lte", "Gt", "Gte", "Re", "In", "Nin", "Between", "Except"}
+
+// machineFields are the Machine fields that can be filtered on
+var machineFields = []string{
+	"Address", "Arch", "Available", "BootEnv", "Context", "CurrentJob", "CurrentTask",
+	"Description", "Endpoint", "HardwareAddrs", "Locked", "Name", "OS", "Pool",
+	"PoolAllocated", "PoolStatus", "Profiles", "ReadOnly", "Runnable", "Stage",
+	"Tasks", "Uuid", "Valid", "Validated", "WorkOrderMode", "Workflow", "WorkflowComplete",
+}
+
+// FilterModel describes a filter block.
+type FilterModel struct {
+	Field types.String `tfsdk:"field"`
+	Op    types.String `tfsdk:"op"`
+	Value types.String `tfsdk:"value"`
+}
+
+var filterType = types.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"field": types.StringType,
+		"op":    types.StringType,
+		"value": types.StringType,
+	},
+}
+
+/*
+ * Returns the filter in Digital Rebar format, e.g. Field=Op(value).
+ */
+func (f FilterModel) String() string {
+	op := f.Op.ValueString()
+	if op == "" {
+		op = "Eq"
+	}
+	return fmt.Sprintf("%s=%s(%s)", f.Field.ValueString(), op, f.Value.ValueString())
+}
+
+/*
+ * Checks the operator and value of a filter block.
+ */
+func (f FilterModel) validate(at path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if f.Op.IsUnknown() || f.Op.IsNull() {
+		return diags
+	}
+	op := f.Op.ValueString()
+	known := false
+	for _, o := range filterOps {
+		if o == op {
+			known = true
+		}
+	}
+	if !known {
+		detail := fmt.Sprintf("Valid operators are %s.", strings.Join(filterOps, ", "))
+		if matches := closeMatches(op, filterOps); len(matches) > 0 {
+			detail = fmt.Sprintf("Did you mean %s? %s", strings.Join(matches, ", "), detail)
+		}
+		diags.AddAttributeError(at.AtName("op"), fmt.Sprintf("Unknown filter operator %s", op), detail)
+		return diags
+	}
+	if op == "Between" && !f.Value.IsUnknown() && len(strings.Split(f.Value.ValueString(), ",")) != 2 {
+		diags.AddAttributeError(at.AtName("value"), "Between needs two values",
+			fmt.Sprintf("Expected \"lower,upper\", got %q", f.Value.ValueString()))
+	}
+	return diags
+}
+
+/*
+ * Returns the filters for allocateMachines: the default filters (or
+ * default_filters when set), the filters list and the filter blocks.
+ */
+func allocationFilters(ctx context.Context, plan *MachineResourceModel) ([]string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	allFilters := append([]string{}, defaultFilters...)
+	if !plan.DefaultFilters.IsNull() && !plan.DefaultFilters.IsUnknown() {
+		allFilters = []string{}
+		diags.Append(plan.DefaultFilters.ElementsAs(ctx, &allFilters, false)...)
+	}
+	filters := []string{}
+	diags.Append(plan.Filters.ElementsAs(ctx, &filters, false)...)
+	allFilters = append(allFilters, filters...)
+
+	blocks := []FilterModel{}
+	diags.Append(plan.Filter.ElementsAs(ctx, &blocks, false)...)
+	for i, f := range blocks {
+		diags.Append(f.validate(path.Root("filter").AtListIndex(i))...)
+		allFilters = append(allFilters, f.String())
+	}
+	return allFilters, diags
+}
+
+/*
+ * Checks that filter block fields are machine fields or params defined
+ * on the endpoint.
+ */
+func (idx *objectIndex) checkFilterFields(ctx context.Context, diags *diag.Diagnostics, plan, state types.List) {
+	if plan.IsUnknown() || plan.IsNull() || plan.Equal(state) {
+		return
+	}
+	blocks := []FilterModel{}
+	diags.Append(plan.ElementsAs(ctx, &blocks, false)...)
+	for i, f := range blocks {
+		if f.Field.IsUnknown() || f.Field.IsNull() {
+			continue
+		}
+		field := f.Field.ValueString()
+		known := false
+		for _, n := range machineFields {
+			if n == field {
+				known = true
+			}
+		}
+		if known {
+			continue
+		}
+		params, err := idx.list(ctx, "params")
+		if err != nil {
+			diags.AddAttributeWarning(path.Root("filter").AtListIndex(i).AtName("field"),
+				fmt.Sprintf("Unable to list params to validate filter field %s", field), err.Error())
+			continue
+		}
+		for _, n := range params {
+			if n == field {
+				known = true
+			}
+		}
+		if known {
+			continue
+		}
+		detail := "Filter fields must be Machine fields or params defined on the endpoint."
+		if matches := closeMatches(field, append(append([]string{}, machineFields...), params...)); len(matches) > 0 {
+			detail = fmt.Sprintf("Did you mean %s? %s", strings.Join(matches, ", "), detail)
+		}
+		diags.AddAttributeError(path.Root("filter").AtListIndex(i).AtName("field"),
+			fmt.Sprintf("Unknown filter field %s", field), detail)
+	}
+}
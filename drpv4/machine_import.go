@@ -0,0 +1,273 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// allocationRecordParam records the allocation settings on the machine for import
+const allocationRecordParam = "terraform/allocation"
+
+// allocationRecord is the drp_machine configuration used to allocate a machine
+type allocationRecord struct {
+	Pool                 string         `json:"pool"`
+	Machine              string         `json:"machine,omitempty"`
+	Timeout              string         `json:"timeout,omitempty"`
+	AllocateWorkflow     string         `json:"allocate_workflow,omitempty"`
+	DeallocateWorkflow   string         `json:"deallocate_workflow,omitempty"`
+	AddProfiles          []string       `json:"add_profiles,omitempty"`
+	AddParameters        []string       `json:"add_parameters,omitempty"`
+	Filters              []string       `json:"filters,omitempty"`
+	AuthorizedKeys       []string       `json:"authorized_keys,omitempty"`
+	DeallocateProfiles   []string       `json:"deallocate_profiles,omitempty"`
+	DeallocateParameters []string       `json:"deallocate_parameters,omitempty"`
+	DefaultFilters       *[]string      `json:"default_filters,omitempty"`
+	Filter               []recordFilter `json:"filter,omitempty"`
+	SpreadBy             string         `json:"spread_by,omitempty"`
+	PlacementGroup       string         `json:"placement_group,omitempty"`
+	Mode                 string         `json:"mode,omitempty"`
+	// The name, description and meta the machine had before allocation
+	OriginalName        *string       `json:"original_name,omitempty"`
+	OriginalDescription *string       `json:"original_description,omitempty"`
+	OriginalMeta        []paramChange `json:"original_meta,omitempty"`
+}
+
+// recordFilter is a filter block in the allocation record
+type recordFilter struct {
+	Field string `json:"field"`
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value"`
+}
+
+/*
+ * Builds the allocation record from the plan.
+ */
+func newAllocationRecord(ctx context.Context, plan *MachineResourceModel) (*allocationRecord, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	rec := &allocationRecord{
+		Pool:               plan.Pool.ValueString(),
+		Machine:            plan.Machine.ValueString(),
+		Timeout:            plan.Timeout.ValueString(),
+		AllocateWorkflow:   plan.AllocateWorkflow.ValueString(),
+		DeallocateWorkflow: plan.DeallocateWorkflow.ValueString(),
+		SpreadBy:           plan.SpreadBy.ValueString(),
+		PlacementGroup:     plan.PlacementGroup.ValueString(),
+		Mode:               plan.Mode.ValueString(),
+	}
+	lists := map[*[]string]types.List{
+		&rec.AddProfiles:          plan.AddProfiles,
+		&rec.AddParameters:        plan.AddParameters,
+		&rec.Filters:              plan.Filters,
+		&rec.AuthorizedKeys:       plan.AuthorizedKeys,
+		&rec.DeallocateProfiles:   plan.DeallocateProfiles,
+		&rec.DeallocateParameters: plan.DeallocateParameters,
+	}
+	for dest, list := range lists {
+		diags.Append(list.ElementsAs(ctx, dest, false)...)
+	}
+	if !plan.DefaultFilters.IsNull() {
+		df := []string{}
+		diags.Append(plan.DefaultFilters.ElementsAs(ctx, &df, false)...)
+		rec.DefaultFilters = &df
+	}
+	blocks := []FilterModel{}
+	diags.Append(plan.Filter.ElementsAs(ctx, &blocks, false)...)
+	for _, f := range blocks {
+		rec.Filter = append(rec.Filter, recordFilter{
+			Field: f.Field.ValueString(),
+			Op:    f.Op.ValueString(),
+			Value: f.Value.ValueString(),
+		})
+	}
+	return rec, diags
+}
+
+/*
+ * Updates the allocation record of the machine.  Machines allocated by
+ * older versions have no record to update.
+ */
+func (r *MachineResource) updateRecord(ctx context.Context, uuid string, update func(rec *allocationRecord)) error {
+	rec := &allocationRecord{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines", uuid, "params", allocationRecordParam).Do(rec); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if rec.Pool == "" {
+		return nil
+	}
+	update(rec)
+	res := &allocationRecord{}
+	return r.session.Req().Context(ctx).Post(rec).UrlFor("machines", uuid, "params", allocationRecordParam).Do(res)
+}
+
+/*
+ * Records the original name, description and meta of the machine in its
+ * allocation record so they can be restored after an import.
+ */
+func (r *MachineResource) recordLabels(ctx context.Context, uuid string, changes *machineChanges) error {
+	return r.updateRecord(ctx, uuid, func(rec *allocationRecord) {
+		rec.OriginalName, rec.OriginalDescription, rec.OriginalMeta = changes.Name, changes.Description, changes.Meta
+	})
+}
+
+/*
+ * Returns a string attribute value, null when empty.
+ */
+func optionalString(s string) types.String {
+	if s == "" {
+		return types.StringNull()
+	}
+	return types.StringValue(s)
+}
+
+/*
+ * Returns a list attribute value, null when empty.
+ */
+func optionalList(ctx context.Context, l []string) (types.List, diag.Diagnostics) {
+	if len(l) == 0 {
+		return types.ListNull(types.StringType), nil
+	}
+	return types.ListValueFrom(ctx, types.StringType, l)
+}
+
+/*
+ * Resolves an import ID to a machine.  Accepted forms are <uuid>,
+ * Name:<machine-name> and <pool>/<uuid>.
+ */
+func (r *MachineResource) resolveImportID(ctx context.Context, id string) (*models.Machine, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	pool := ""
+	key := id
+	if !strings.HasPrefix(id, "Name:") {
+		if parts := strings.SplitN(id, "/", 2); len(parts) == 2 {
+			pool, key = parts[0], parts[1]
+		}
+	}
+	if key == "" || key == "Name:" {
+		diags.AddError("Invalid import ID",
+			fmt.Sprintf("Expected <uuid>, Name:<machine-name> or <pool>/<uuid>, got %q", id))
+		return nil, diags
+	}
+
+	machine, err := r.getMachine(ctx, key)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", key), err.Error())
+		return nil, diags
+	}
+	if pool != "" && machine.Pool != pool {
+		diags.AddError(fmt.Sprintf("Machine %s is not in pool %s", key, pool),
+			fmt.Sprintf("The machine is in pool %s.", machine.Pool))
+		return nil, diags
+	}
+	if !allocatedStatus(machine.PoolStatus) {
+		diags.AddError(fmt.Sprintf("Machine %s is not allocated", key),
+			fmt.Sprintf("The machine has pool status %s in pool %s.  Only allocated machines can be imported.", machine.PoolStatus, machine.Pool))
+		return nil, diags
+	}
+	return machine, diags
+}
+
+func (r *MachineResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	tflog.Debug(ctx, fmt.Sprintf("[resourceMachineImport] Importing drp_machine %s", req.ID))
+
+	machine, diags := r.resolveImportID(ctx, req.ID)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	rec := &allocationRecord{}
+	if val, ok := machine.Params[allocationRecordParam]; ok {
+		if err := models.Remarshal(val, rec); err != nil {
+			resp.Diagnostics.AddWarning(fmt.Sprintf("Unable to decode the %s param", allocationRecordParam), err.Error())
+		}
+	} else {
+		resp.Diagnostics.AddWarning(
+			fmt.Sprintf("Machine %s has no allocation record", machine.Uuid.String()),
+			"The machine was not allocated by this provider version, so only pool and defaults were imported.  Check the next plan for differences.")
+	}
+	if rec.Pool == "" {
+		rec.Pool = machine.Pool
+	}
+	if rec.Timeout == "" {
+		rec.Timeout = "5m"
+	}
+	if rec.Mode == "" {
+		rec.Mode = modeProvision
+	}
+
+	strs := map[string]types.String{
+		"id":                  types.StringValue(machine.Uuid.String()),
+		"pool":                types.StringValue(rec.Pool),
+		"machine":             optionalString(rec.Machine),
+		"timeout":             types.StringValue(rec.Timeout),
+		"allocate_workflow":   optionalString(rec.AllocateWorkflow),
+		"deallocate_workflow": optionalString(rec.DeallocateWorkflow),
+		"on_failure":          types.StringValue(onFailureError),
+		"on_destroy":          types.StringValue(onDestroyRelease),
+		"mode":                types.StringValue(rec.Mode),
+		"spread_by":           optionalString(rec.SpreadBy),
+		"placement_group":     optionalString(rec.PlacementGroup),
+	}
+	for name, val := range strs {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root(name), val)...)
+	}
+	lists := map[string][]string{
+		"add_profiles":          rec.AddProfiles,
+		"add_parameters":        rec.AddParameters,
+		"filters":               rec.Filters,
+		"authorized_keys":       rec.AuthorizedKeys,
+		"deallocate_profiles":   rec.DeallocateProfiles,
+		"deallocate_parameters": rec.DeallocateParameters,
+	}
+	for name, l := range lists {
+		val, diags := optionalList(ctx, l)
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root(name), val)...)
+	}
+	defaultFilters := types.ListNull(types.StringType)
+	if rec.DefaultFilters != nil {
+		defaultFilters, diags = types.ListValueFrom(ctx, types.StringType, *rec.DefaultFilters)
+		resp.Diagnostics.Append(diags...)
+	}
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("default_filters"), defaultFilters)...)
+	blocks := []FilterModel{}
+	for _, f := range rec.Filter {
+		blocks = append(blocks, FilterModel{
+			Field: types.StringValue(f.Field),
+			Op:    optionalString(f.Op),
+			Value: types.StringValue(f.Value),
+		})
+	}
+	filter, diags := types.ListValueFrom(ctx, filterType, blocks)
+	resp.Diagnostics.Append(diags...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("filter"), filter)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("job_log_lines"), types.Int64Value(defaultJobLogLines))...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("failure_retries"), types.Int64Value(1))...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("wait_for_available"), types.BoolValue(false))...)
+
+	// Only the labels are known from before allocation, the rest is released the legacy way.
+	changes := &machineChanges{
+		Name:        rec.OriginalName,
+		Description: rec.OriginalDescription,
+		Meta:        rec.OriginalMeta,
+		Untracked:   true,
+	}
+	resp.Diagnostics.Append(saveChanges(ctx, resp.Private, changes)...)
+}
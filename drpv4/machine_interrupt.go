@@ -0,0 +1,80 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// allocationParam tags machines with the allocation that claimed them
+const allocationParam = "terraform/allocation-id"
+
+// interruptCleanupTimeout bounds the cleanup after an interrupted allocation
+const interruptCleanupTimeout = 2 * time.Minute
+
+/*
+ * Returns a random token identifying a single allocateMachines call.
+ */
+func newAllocationToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+/*
+ * Finds machines the server allocated for an allocateMachines call that
+ * was cancelled or timed out, and releases them.  A machine that cannot
+ * be released is returned so it can be recorded in state instead of
+ * leaking.
+ *
+ * The request context is already done at this point, so the cleanup runs
+ * on its own deadline.
+ */
+func (r *MachineResource) cleanupInterrupted(ctx context.Context, plan *MachineResourceModel, token string) (*models.Machine, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	cctx, cancel := context.WithTimeout(context.Background(), interruptCleanupTimeout)
+	defer cancel()
+
+	pool := plan.Pool.ValueString()
+	machines := []*models.Machine{}
+	if err := r.session.Req().Context(cctx).UrlFor("machines").Params(allocationParam, token).Do(&machines); err != nil {
+		diags.AddWarning(
+			"Unable to check for machines allocated by the interrupted operation",
+			fmt.Sprintf("Look for machines in pool %s with the %s param set to %s: %s", pool, allocationParam, token, err))
+		return nil, diags
+	}
+
+	for _, machine := range machines {
+		uuid := machine.Uuid.String()
+		tflog.Warn(ctx, fmt.Sprintf("Releasing machine %s allocated by the interrupted operation", uuid))
+		// Only the claim completed, so nothing else was changed on the machine.
+		parms, pdiags := r.releaseParms(cctx, plan, uuid, &machineChanges{})
+		diags.Append(pdiags...)
+		if pdiags.HasError() {
+			return machine, diags
+		}
+		if _, err := r.release(cctx, pool, parms); err != nil {
+			diags.AddWarning(
+				fmt.Sprintf("Machine %s was allocated by the interrupted operation", uuid),
+				fmt.Sprintf("Releasing it failed (%s), so it was recorded in state.  Run terraform destroy or apply to clean it up.", err))
+			return machine, diags
+		}
+		diags.AddWarning(
+			fmt.Sprintf("Machine %s was allocated by the interrupted operation", uuid),
+			fmt.Sprintf("The machine was released back to pool %s.", pool))
+	}
+	return nil, diags
+}
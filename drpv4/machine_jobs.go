@@ -0,0 +1,83 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/api"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// defaultJobLogLines is the number of job log lines reported when job_log_lines is not set
+const defaultJobLogLines = 20
+
+/*
+ * Returns the most recent failed job for the machine, or nil if the
+ * machine has no failed jobs.
+ */
+func lastFailedJob(ctx context.Context, session *api.Client, uuid string) (*models.Job, error) {
+	jobs := []*models.Job{}
+	err := session.Req().Context(ctx).UrlFor("jobs").Params(
+		"Machine", uuid,
+		"State", "failed",
+		"sort", "StartTime",
+		"reverse", "true",
+		"limit", "1").Do(&jobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return jobs[0], nil
+}
+
+/*
+ * Returns the last lines of the log for a job.
+ */
+func jobLogTail(ctx context.Context, session *api.Client, uuid string, lines int) (string, error) {
+	buf := &bytes.Buffer{}
+	err := session.Req().Context(ctx).UrlFor("jobs", uuid, "log").Headers("Accept", "application/octet-stream").Do(buf)
+	if err != nil {
+		return "", err
+	}
+	log := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if lines > 0 && len(log) > lines {
+		log = log[len(log)-lines:]
+	}
+	return strings.Join(log, "\n"), nil
+}
+
+/*
+ * Builds the diagnostic detail for a machine stuck in HoldBuild from its
+ * most recent failed job.  Lookup failures are folded into the detail so
+ * the original error is always reported.
+ */
+func (r *MachineResource) holdBuildDetail(ctx context.Context, uuid string, lines int) string {
+	job, err := lastFailedJob(ctx, r.session, uuid)
+	if err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("Failed to lookup failed jobs for machine %s: %v", uuid, err))
+		return fmt.Sprintf("Unable to lookup the failed job: %v. Investigate the cause on the DRP endpoint.", err)
+	}
+	if job == nil {
+		return "No failed job was found. Investigate the cause on the DRP endpoint."
+	}
+	detail := fmt.Sprintf("Job %s failed running task %s in stage %s (workflow %s).",
+		job.Uuid.String(), job.Task, job.Stage, job.Workflow)
+	if lines == 0 {
+		return detail
+	}
+	tail, err := jobLogTail(ctx, r.session, job.Uuid.String(), lines)
+	if err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("Failed to fetch log for job %s: %v", job.Uuid.String(), err))
+		return fmt.Sprintf("%s\nUnable to fetch the job log: %v", detail, err)
+	}
+	return fmt.Sprintf("%s\nLast %d lines of the job log:\n%s", detail, lines, tail)
+}
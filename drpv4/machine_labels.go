@@ -0,0 +1,178 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+/*
+ * Sets hostname, description and meta on the machine.  The state is nil
+ * on create.  Values the provider stops managing are reverted.  The
+ * values they replaced are recorded in the changes, once, so release
+ * can restore the machine to how it was before allocation.
+ */
+func (r *MachineResource) updateLabels(ctx context.Context, plan, state *MachineResourceModel, uuid string, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	planMeta, stateMeta := map[string]string{}, map[string]string{}
+	diags.Append(plan.Meta.ElementsAs(ctx, &planMeta, false)...)
+	if state != nil {
+		diags.Append(state.Meta.ElementsAs(ctx, &stateMeta, false)...)
+	}
+	if diags.HasError() {
+		return diags
+	}
+
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return diags
+	}
+	updated := models.Clone(machine).(*models.Machine)
+	if updated.Meta == nil {
+		updated.Meta = models.Meta{}
+	}
+	if changes == nil {
+		// Nothing can be reverted for machines allocated by older versions or imported.
+		changes = &machineChanges{}
+	}
+
+	changed := false
+	label := func(value, previous types.String, field *string, recorded **string) {
+		switch {
+		case !value.IsNull() && !value.IsUnknown():
+			if *field == value.ValueString() {
+				return
+			}
+			if *recorded == nil {
+				original := *field
+				*recorded = &original
+			}
+			*field = value.ValueString()
+			changed = true
+		case value.IsNull() && !previous.IsNull() && *recorded != nil:
+			*field = **recorded
+			*recorded = nil
+			changed = true
+		}
+	}
+	var previousHostname, previousDescription types.String = types.StringNull(), types.StringNull()
+	if state != nil {
+		previousHostname, previousDescription = state.Hostname, state.Description
+	}
+	label(plan.Hostname, previousHostname, &updated.Name, &changes.Name)
+	label(plan.Description, previousDescription, &updated.Description, &changes.Description)
+
+	for key, value := range planMeta {
+		current, ok := updated.Meta[key]
+		if ok && current == value {
+			continue
+		}
+		if changes.metaChange(key) == nil {
+			changes.Meta = append(changes.Meta, paramChange{Name: key, Replaced: ok, Previous: current})
+		}
+		updated.Meta[key] = value
+		changed = true
+	}
+	for key := range stateMeta {
+		if _, ok := planMeta[key]; ok {
+			continue
+		}
+		if changes.revertMeta(updated.Meta, key) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return diags
+	}
+	tflog.Debug(ctx, fmt.Sprintf("Updating name, description and meta of machine %s", uuid))
+	if err := r.patchMachine(ctx, machine, updated); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to update hostname, description or meta of machine %s", uuid), err.Error())
+		return diags
+	}
+	if err := r.recordLabels(ctx, uuid, changes); err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("Failed to record the original labels of machine %s: %v", uuid, err))
+	}
+	return diags
+}
+
+/*
+ * Restores the name, description and meta recorded before allocation.
+ */
+func (r *MachineResource) revertLabels(ctx context.Context, uuid string, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if changes == nil || (changes.Name == nil && changes.Description == nil && len(changes.Meta) == 0) {
+		return diags
+	}
+
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return diags
+	}
+	updated := models.Clone(machine).(*models.Machine)
+	if updated.Meta == nil {
+		updated.Meta = models.Meta{}
+	}
+	if changes.Name != nil {
+		updated.Name = *changes.Name
+	}
+	if changes.Description != nil {
+		updated.Description = *changes.Description
+	}
+	for len(changes.Meta) > 0 {
+		changes.revertMeta(updated.Meta, changes.Meta[0].Name)
+	}
+	changes.Name, changes.Description = nil, nil
+
+	if err := r.patchMachine(ctx, machine, updated); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to restore the name, description and meta of machine %s", uuid), err.Error())
+	}
+	return diags
+}
+
+/*
+ * Returns the recorded change of a meta key.
+ */
+func (c *machineChanges) metaChange(key string) *paramChange {
+	for i := range c.Meta {
+		if c.Meta[i].Name == key {
+			return &c.Meta[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * Restores a meta key to its recorded value and forgets the change.
+ * Reports if anything was recorded for the key.
+ */
+func (c *machineChanges) revertMeta(meta models.Meta, key string) bool {
+	change := c.metaChange(key)
+	if change == nil {
+		return false
+	}
+	if previous, ok := change.Previous.(string); ok && change.Replaced {
+		meta[key] = previous
+	} else {
+		delete(meta, key)
+	}
+	kept := c.Meta[:0]
+	for _, m := range c.Meta {
+		if m.Name != key {
+			kept = append(kept, m)
+		}
+	}
+	c.Meta = kept
+	return true
+}
@@ -0,0 +1,74 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// mode values
+const (
+	modeProvision = "provision"
+	modeReserve   = "reserve"
+)
+
+/*
+ * Reports if the machine is only reserved.  An unknown mode is the
+ * provision default.
+ */
+func (m *MachineResourceModel) reserved() bool {
+	return m.Mode.ValueString() == modeReserve
+}
+
+/*
+ * Provisions a reserved machine in place by running allocate_workflow,
+ * or the allocate workflow of the pool when it is not set.  The
+ * on_failure policy is applied when the workflow lands in HoldBuild,
+ * except for replace which takes effect on the next plan.
+ */
+func (r *MachineResource) provisionReserved(ctx context.Context, plan *MachineResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	uuid := plan.Id.ValueString()
+	workflow, err := r.allocateWorkflow(ctx, plan)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get the allocate workflow of pool %s", plan.Pool.ValueString()), err.Error())
+		return diags
+	}
+	if workflow == "" {
+		return diags
+	}
+	tflog.Info(ctx, fmt.Sprintf("Provisioning reserved machine %s with workflow %s", uuid, workflow))
+	status, err := r.runWorkflow(ctx, uuid, workflow)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Could not run workflow %s on machine %s", workflow, uuid), err.Error())
+		return diags
+	}
+	plan.Status = types.StringValue(string(status))
+	if status != "HoldBuild" {
+		return diags
+	}
+
+	if plan.OnFailure.ValueString() == onFailureRetryWorkflow {
+		mc := &models.PoolResult{
+			Name:   plan.Name.ValueString(),
+			Uuid:   uuid,
+			Status: status,
+		}
+		mc, diags = r.recoverAllocation(ctx, plan, nil, mc, nil)
+		plan.Status = types.StringValue(string(mc.Status))
+		return diags
+	}
+	diags.AddError(
+		fmt.Sprintf("Workflow %s left machine %s in HoldBuild", workflow, uuid),
+		r.holdBuildDetail(ctx, uuid, int(plan.JobLogLines.ValueInt64())))
+	return diags
+}
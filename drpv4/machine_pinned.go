@@ -0,0 +1,59 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+/*
+ * Looks up a machine by uuid or by name.
+ */
+func (r *MachineResource) findMachine(ctx context.Context, key string) (*models.Machine, error) {
+	machine, err := r.getMachine(ctx, key)
+	if err == nil || !isNotFound(err) {
+		return machine, err
+	}
+	return r.getMachine(ctx, "Name:"+key)
+}
+
+/*
+ * Resolves the machine pinned by the machine attribute and checks that
+ * it can be allocated from the pool.  A machine that is busy in the pool
+ * is accepted when waiting for availability.
+ */
+func (r *MachineResource) resolvePinned(ctx context.Context, plan *MachineResourceModel) (*models.Machine, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	key := plan.Machine.ValueString()
+	pool := plan.Pool.ValueString()
+	machine, err := r.findMachine(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			diags.AddAttributeError(path.Root("machine"), fmt.Sprintf("Machine %s does not exist", key), "No machine has that uuid or name.")
+		} else {
+			diags.AddAttributeError(path.Root("machine"), fmt.Sprintf("Unable to get machine: %s", key), err.Error())
+		}
+		return nil, diags
+	}
+	if machine.Pool != pool {
+		diags.AddAttributeError(path.Root("machine"),
+			fmt.Sprintf("Machine %s is not in pool %s", key, pool),
+			fmt.Sprintf("Machine %s (%s) is in pool %s with pool status %s.", machine.Name, machine.Uuid.String(), machine.Pool, machine.PoolStatus))
+		return nil, diags
+	}
+	if machine.PoolStatus != "Free" && !plan.WaitForAvailable.ValueBool() {
+		diags.AddAttributeError(path.Root("machine"),
+			fmt.Sprintf("Machine %s is not free in pool %s", key, pool),
+			fmt.Sprintf("Machine %s (%s) has pool status %s.  Set wait_for_available to wait for it to be released.", machine.Name, machine.Uuid.String(), machine.PoolStatus))
+		return nil, diags
+	}
+	return machine, diags
+}
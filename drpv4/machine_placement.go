@@ -0,0 +1,100 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// placementGroupParam tags machines with the placement group they were allocated for
+const placementGroupParam = "terraform/placement-group"
+
+// placementLocks serializes allocations that share a placement group within the provider
+var placementLocks sync.Map
+
+/*
+ * Locks the placement group and returns the unlock function.
+ */
+func lockPlacement(group string) func() {
+	l, _ := placementLocks.LoadOrStore(group, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+/*
+ * Returns the value of a machine param or field used for spreading.
+ */
+func spreadValue(machine *models.Machine, key string) (string, bool) {
+	if v, ok := machine.Params[key]; ok && v != nil {
+		return fmt.Sprint(v), true
+	}
+	fields := map[string]interface{}{}
+	if err := models.Remarshal(machine, &fields); err != nil {
+		return "", false
+	}
+	if v, ok := fields[key]; ok && v != nil && fmt.Sprint(v) != "" {
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+/*
+ * Builds the filter that spreads a new machine of the placement group
+ * away from the spread_by values already used by the group.  Values used
+ * the least are preferred when every value is taken; no filter is
+ * returned when nothing else is free.
+ */
+func (r *MachineResource) spreadFilter(ctx context.Context, group, key, pool string, filters []string) (string, error) {
+	machines := []*models.Machine{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines").Params(placementGroupParam, group).Do(&machines); err != nil {
+		return "", err
+	}
+	used := map[string]int{}
+	for _, m := range machines {
+		if v, ok := spreadValue(m, key); ok {
+			used[v]++
+		}
+	}
+	if len(used) == 0 {
+		return "", nil
+	}
+
+	counts := []int{}
+	for _, c := range used {
+		counts = append(counts, c)
+	}
+	sort.Ints(counts)
+	// Start by excluding every used value, then allow the least used ones.
+	for _, limit := range append([]int{0}, counts...) {
+		exclude := []string{}
+		for v, c := range used {
+			if c > limit {
+				exclude = append(exclude, v)
+			}
+		}
+		if len(exclude) == 0 {
+			break
+		}
+		sort.Strings(exclude)
+		filter := fmt.Sprintf("%s=Nin(%s)", key, strings.Join(exclude, ","))
+		count, err := r.countAvailable(ctx, pool, append(append([]string{}, filters...), filter))
+		if err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return filter, nil
+		}
+	}
+	tflog.Warn(ctx, fmt.Sprintf("No free machine in pool %s spreads placement group %s by %s", pool, group, key))
+	return "", nil
+}
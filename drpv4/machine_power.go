@@ -0,0 +1,87 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// power states reported and accepted by power_state
+const (
+	powerOn  = "on"
+	powerOff = "off"
+)
+
+/*
+ * Runs a machine action provided by the IPMI or Redfish plugin.
+ */
+func (r *MachineResource) machineAction(ctx context.Context, uuid, command string) (interface{}, error) {
+	var res interface{}
+	err := r.session.Req().Context(ctx).Post(map[string]interface{}{}).UrlFor("machines", uuid, "actions", command).Do(&res)
+	return res, err
+}
+
+/*
+ * Returns the current power state of the machine as on or off.
+ */
+func (r *MachineResource) powerStatus(ctx context.Context, uuid string) (string, error) {
+	res, err := r.machineAction(ctx, uuid, "powerstatus")
+	if err != nil {
+		return "", err
+	}
+	status := strings.ToLower(strings.TrimSpace(fmt.Sprint(res)))
+	switch {
+	case strings.HasSuffix(status, powerOff):
+		return powerOff, nil
+	case strings.HasSuffix(status, powerOn):
+		return powerOn, nil
+	}
+	return "", fmt.Errorf("unexpected power status %q", status)
+}
+
+/*
+ * Applies power_state and power_cycle_trigger to the machine.  The state
+ * is nil on create, where the trigger only records its initial value.
+ */
+func (r *MachineResource) applyPower(ctx context.Context, plan, state *MachineResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	uuid := plan.Id.ValueString()
+	desired := ""
+	if !plan.PowerState.IsNull() && !plan.PowerState.IsUnknown() {
+		desired = plan.PowerState.ValueString()
+	}
+	cycle := state != nil && !plan.PowerCycleTrigger.IsNull() && !plan.PowerCycleTrigger.Equal(state.PowerCycleTrigger)
+
+	if cycle && desired != powerOff {
+		tflog.Info(ctx, fmt.Sprintf("Power cycling machine %s", uuid))
+		if _, err := r.machineAction(ctx, uuid, "powercycle"); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to power cycle machine %s", uuid), err.Error())
+		}
+		return diags
+	}
+	if desired == "" {
+		return diags
+	}
+	current, err := r.powerStatus(ctx, uuid)
+	if err != nil {
+		// Never act on an unknown power state.
+		diags.AddError(fmt.Sprintf("Unable to get the power state of machine %s", uuid), err.Error())
+		return diags
+	}
+	if current == desired {
+		return diags
+	}
+	tflog.Info(ctx, fmt.Sprintf("Powering %s machine %s", desired, uuid))
+	if _, err := r.machineAction(ctx, uuid, "power"+desired); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to power %s machine %s", desired, uuid), err.Error())
+	}
+	return diags
+}
@@ -0,0 +1,151 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// ready_check defaults
+const (
+	defaultReadyPort     = 22
+	defaultReadyProtocol = "tcp"
+	defaultReadyTimeout  = 5 * time.Minute
+	readyInterval        = 5 * time.Second
+	readyDialTimeout     = 10 * time.Second
+)
+
+// ReadyCheckModel describes the ready_check block.
+type ReadyCheckModel struct {
+	Port     types.Int64  `tfsdk:"port"`
+	Protocol types.String `tfsdk:"protocol"`
+	Timeout  types.String `tfsdk:"timeout"`
+	Banner   types.String `tfsdk:"banner"`
+}
+
+/*
+ * Builds the ready_check { port, protocol, timeout, banner } block.
+ */
+func readyCheckBlock() schema.Block {
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "Wait after allocation until the machine accepts connections on its address.",
+		Attributes: map[string]schema.Attribute{
+			"port": schema.Int64Attribute{
+				MarkdownDescription: "Port to connect to.  Defaults to 22.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.Between(1, 65535),
+				},
+			},
+			"protocol": schema.StringAttribute{
+				MarkdownDescription: "`tcp` or `tls`.  Defaults to `tcp`.",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.OneOf("tcp", "tls"),
+				},
+			},
+			"timeout": schema.StringAttribute{
+				MarkdownDescription: "Maximum time to wait for the machine to accept connections.  Time string format, defaults to 5m.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"banner": schema.StringAttribute{
+				MarkdownDescription: "Text the service must send after connecting, e.g. `SSH-2.0`.",
+				Optional:            true,
+			},
+		},
+	}
+}
+
+/*
+ * Polls the address until the ready check passes or its timeout ends.
+ */
+func (c *ReadyCheckModel) wait(ctx context.Context, address string) error {
+	if address == "" || address == "<nil>" {
+		return fmt.Errorf("the machine has no address")
+	}
+	port := int64(defaultReadyPort)
+	if !c.Port.IsNull() && !c.Port.IsUnknown() {
+		port = c.Port.ValueInt64()
+	}
+	timeout := defaultReadyTimeout
+	if d, err := time.ParseDuration(c.Timeout.ValueString()); err == nil {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	target := net.JoinHostPort(address, strconv.FormatInt(port, 10))
+	for {
+		err := c.probe(ctx, target)
+		if err == nil {
+			return nil
+		}
+		tflog.Debug(ctx, fmt.Sprintf("Machine at %s is not ready: %v", target, err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not become ready within %s: %v", target, timeout, err)
+		case <-time.After(readyInterval):
+		}
+	}
+}
+
+/*
+ * Connects to the target once and checks the banner when one is set.
+ */
+func (c *ReadyCheckModel) probe(ctx context.Context, target string) error {
+	dialer := &net.Dialer{Timeout: readyDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	protocol := defaultReadyProtocol
+	if p := c.Protocol.ValueString(); p != "" {
+		protocol = p
+	}
+	if protocol == "tls" {
+		host, _, _ := net.SplitHostPort(target)
+		// Only reachability is checked, machines rarely have trusted certificates.
+		tconn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		tconn.SetDeadline(time.Now().Add(readyDialTimeout))
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tconn
+	}
+
+	banner := c.Banner.ValueString()
+	if banner == "" {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(readyDialTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if !strings.Contains(line, banner) {
+		if err != nil {
+			return fmt.Errorf("no banner received: %w", err)
+		}
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(line))
+	}
+	return nil
+}
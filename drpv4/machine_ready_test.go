@@ -0,0 +1,102 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+/*
+ * Starts a local listener that sends the banner to every connection.
+ * Returns the host and port of the listener.
+ */
+func readyListener(t *testing.T, banner string) (string, int64) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), int64(addr.Port)
+}
+
+/*
+ * Builds a tcp ready check with a short timeout.
+ */
+func readyCheck(port int64, banner string) *ReadyCheckModel {
+	c := &ReadyCheckModel{
+		Port:     types.Int64Value(port),
+		Protocol: types.StringValue("tcp"),
+		Timeout:  types.StringValue("1s"),
+		Banner:   types.StringNull(),
+	}
+	if banner != "" {
+		c.Banner = types.StringValue(banner)
+	}
+	return c
+}
+
+func TestReadyCheckConnect(t *testing.T) {
+	host, port := readyListener(t, "")
+	if err := readyCheck(port, "").wait(context.Background(), host); err != nil {
+		t.Fatalf("expected the listener to be ready: %v", err)
+	}
+}
+
+func TestReadyCheckBanner(t *testing.T) {
+	host, port := readyListener(t, "SSH-2.0-OpenSSH_8.9\r\n")
+	if err := readyCheck(port, "SSH-2.0").wait(context.Background(), host); err != nil {
+		t.Fatalf("expected the banner to match: %v", err)
+	}
+}
+
+func TestReadyCheckBannerMismatch(t *testing.T) {
+	host, port := readyListener(t, "HTTP/1.1 400 Bad Request\r\n")
+	err := readyCheck(port, "SSH-2.0").wait(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "unexpected banner") {
+		t.Fatalf("expected a banner mismatch, got %v", err)
+	}
+}
+
+func TestReadyCheckTimeout(t *testing.T) {
+	// Reserve a port and close it so nothing listens on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	port, _ := strconv.ParseInt(p, 10, 64)
+
+	err = readyCheck(port, "").wait(context.Background(), "127.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestReadyCheckNoAddress(t *testing.T) {
+	if err := readyCheck(22, "").wait(context.Background(), ""); err == nil {
+		t.Fatal("expected an error without an address")
+	}
+}
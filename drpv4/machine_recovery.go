@@ -0,0 +1,214 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// on_failure policies for machines that land in HoldBuild
+const (
+	onFailureError         = "error"
+	onFailureRetryWorkflow = "retry_workflow"
+	onFailureReplace       = "replace"
+)
+
+// pollInterval is how often machines are checked while waiting on a workflow
+const pollInterval = 10 * time.Second
+
+/*
+ * Fills in the on_failure defaults when they are not configured.
+ */
+func setFailureDefaults(plan *MachineResourceModel) {
+	if plan.OnFailure.IsNull() || plan.OnFailure.IsUnknown() {
+		plan.OnFailure = types.StringValue(onFailureError)
+	}
+	if plan.FailureRetries.IsNull() || plan.FailureRetries.IsUnknown() {
+		plan.FailureRetries = types.Int64Value(1)
+	}
+}
+
+/*
+ * Applies the on_failure policy to a machine that finished allocation in
+ * HoldBuild.  Returns the machine that should be recorded in state, which
+ * is nil when a replacement could not be allocated.  The changes are
+ * updated to those made on the returned machine.
+ */
+func (r *MachineResource) recoverAllocation(ctx context.Context, plan *MachineResourceModel, parms map[string]interface{}, mc *models.PoolResult, changes *machineChanges) (*models.PoolResult, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	policy := plan.OnFailure.ValueString()
+	retries := int(plan.FailureRetries.ValueInt64())
+	lines := int(plan.JobLogLines.ValueInt64())
+	pool := plan.Pool.ValueString()
+
+	for attempt := 0; mc.Status == "HoldBuild"; attempt++ {
+		if policy != onFailureRetryWorkflow && policy != onFailureReplace {
+			return mc, diags
+		}
+		if attempt >= retries {
+			diags.AddError(
+				fmt.Sprintf("machine %s stuck in HoldBuild status after %d %s attempts", mc.Uuid, attempt, policy),
+				r.holdBuildDetail(ctx, mc.Uuid, lines))
+			return mc, diags
+		}
+		tflog.Warn(ctx, fmt.Sprintf("Machine %s (%s) in HoldBuild, applying %s policy (attempt %d of %d)", mc.Name, mc.Uuid, policy, attempt+1, retries))
+
+		switch policy {
+		case onFailureRetryWorkflow:
+			status, err := r.runWorkflow(ctx, mc.Uuid, plan.AllocateWorkflow.ValueString())
+			if err != nil {
+				diags.AddError(fmt.Sprintf("Could not restart the workflow on machine %s", mc.Uuid), err.Error())
+				return mc, diags
+			}
+			mc.Status = status
+		case onFailureReplace:
+			diags.Append(r.undoAccessKeys(ctx, plan, mc.Uuid, changes)...)
+			diags.Append(r.revertLabels(ctx, mc.Uuid, changes)...)
+			diags.Append(r.revertWorkOrderMode(ctx, mc.Uuid, changes)...)
+			if diags.HasError() {
+				return mc, diags
+			}
+			rparms, rdiags := r.releaseParms(ctx, plan, mc.Uuid, changes)
+			diags.Append(rdiags...)
+			if diags.HasError() {
+				return mc, diags
+			}
+			if _, err := r.release(ctx, pool, rparms); err != nil {
+				diags.AddError(fmt.Sprintf("Error releasing %s from pool %s: %s", mc.Uuid, pool, err), "")
+				return mc, diags
+			}
+			if qp := plan.QuarantinePool.ValueString(); qp != "" {
+				if err := r.quarantine(ctx, mc.Uuid, pool, qp); err != nil {
+					diags.AddWarning(fmt.Sprintf("Could not quarantine %s in pool %s", mc.Uuid, qp), err.Error())
+				}
+			}
+			parms["pool/filter"] = append(parms["pool/filter"].([]string), fmt.Sprintf("Uuid=Ne(%s)", mc.Uuid))
+			parms["pool/wait-timeout"] = waitTimeout(ctx)
+			next, err := r.allocate(ctx, plan, pool, parms)
+			if err != nil {
+				diags.AddError(fmt.Sprintf("Unable to allocate a replacement for %s from pool %s", mc.Uuid, pool),
+					fmt.Sprintf("%s\n\n%s", err, r.poolReport(ctx, pool, parms)))
+				return nil, diags
+			}
+			mc = next
+			*changes = machineChanges{}
+			diags.Append(r.provision(ctx, plan, mc, changes)...)
+			if diags.HasError() {
+				return mc, diags
+			}
+		}
+	}
+	return mc, diags
+}
+
+/*
+ * Starts the workflow over on a machine and waits for it to finish.  An
+ * empty workflow restarts the current one.  The machine is put back in
+ * Building so the pool moves it to InUse or HoldBuild when the workflow
+ * ends; the resulting pool status is read back from the server.
+ */
+func (r *MachineResource) runWorkflow(ctx context.Context, uuid, workflow string) (models.PoolStatus, error) {
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		return "", err
+	}
+	if workflow == "" {
+		workflow = machine.Workflow
+	}
+	if err := r.startWorkflow(ctx, machine, workflow, "Building"); err != nil {
+		return "", err
+	}
+	tflog.Debug(ctx, fmt.Sprintf("Started workflow %s on machine %s", workflow, uuid))
+
+	if _, err := r.waitForWorkflow(ctx, uuid); err != nil {
+		return "", err
+	}
+	return r.waitForPoolStatus(ctx, uuid)
+}
+
+/*
+ * Waits for the pool to move the machine out of Building and returns the
+ * pool status it settled in.
+ */
+func (r *MachineResource) waitForPoolStatus(ctx context.Context, uuid string) (models.PoolStatus, error) {
+	for {
+		machine, err := r.getMachine(ctx, uuid)
+		if err != nil {
+			return "", err
+		}
+		if machine.PoolStatus != "Building" {
+			return machine.PoolStatus, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("gave up waiting for machine %s to leave Building: %w", uuid, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+/*
+ * Starts a workflow from the beginning on a machine, optionally moving
+ * the machine to a new pool status.
+ */
+func (r *MachineResource) startWorkflow(ctx context.Context, machine *models.Machine, workflow string, status models.PoolStatus) error {
+	// Clearing the workflow first forces DRP to start it over from the beginning.
+	cleared := models.Clone(machine).(*models.Machine)
+	cleared.Workflow = ""
+	if err := r.patchMachine(ctx, machine, cleared); err != nil {
+		return err
+	}
+	started := models.Clone(cleared).(*models.Machine)
+	started.Workflow = workflow
+	started.Runnable = true
+	if status != "" {
+		started.PoolStatus = status
+	}
+	return r.patchMachine(ctx, cleared, started)
+}
+
+/*
+ * Waits for the workflow on a machine to complete or fail.  A failed
+ * workflow leaves the returned machine not Runnable.  Gives up when the
+ * context deadline passes.
+ */
+func (r *MachineResource) waitForWorkflow(ctx context.Context, uuid string) (*models.Machine, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for the workflow on machine %s: %w", uuid, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+
+		machine, err := r.getMachine(ctx, uuid)
+		if err != nil {
+			return nil, err
+		}
+		if !machine.Runnable || machine.WorkflowComplete {
+			return machine, nil
+		}
+	}
+}
+
+/*
+ * Moves a released machine into the quarantine pool.
+ */
+func (r *MachineResource) quarantine(ctx context.Context, uuid, pool, quarantinePool string) error {
+	tflog.Debug(ctx, fmt.Sprintf("Moving machine %s from pool %s to quarantine pool %s", uuid, pool, quarantinePool))
+	parms := map[string]interface{}{
+		"pool/machine-list": []string{uuid},
+	}
+	pr := []*models.PoolResult{}
+	return r.session.Req().Context(ctx).Post(parms).UrlFor("pools", quarantinePool, "addMachines").Do(&pr)
+}
@@ -0,0 +1,78 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// reportTimeout bounds the pool queries made to explain a failed allocation
+const reportTimeout = 30 * time.Second
+
+/*
+ * Explains why an allocation from the pool failed: how many machines the
+ * pool has in each status and how many free machines each filter rules
+ * out.  Query failures are folded into the report so the original error
+ * is always reported.
+ */
+func (r *MachineResource) poolReport(ctx context.Context, pool string, parms map[string]interface{}) string {
+	// The allocation may have failed because the context is done.
+	rctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	machines := []*models.Machine{}
+	if err := r.session.Req().Context(rctx).UrlFor("machines").Params("Pool", pool, "slim", "Params,Meta").Do(&machines); err != nil {
+		return fmt.Sprintf("Unable to list the machines in pool %s: %v", pool, err)
+	}
+	counts := map[string]int{}
+	for _, m := range machines {
+		counts[string(m.PoolStatus)]++
+	}
+	free := counts["Free"]
+	lines := []string{
+		fmt.Sprintf("Pool %s has %d machines: %d free, %d in use, %d in HoldBuild.",
+			pool, len(machines), free, counts["InUse"]+counts["Building"], counts["HoldBuild"]),
+	}
+	others := []string{}
+	for status, count := range counts {
+		switch status {
+		case "Free", "InUse", "Building", "HoldBuild":
+			continue
+		}
+		others = append(others, fmt.Sprintf("%d %s", count, status))
+	}
+	if len(others) > 0 {
+		sort.Strings(others)
+		lines = append(lines, fmt.Sprintf("Other statuses: %s.", strings.Join(others, ", ")))
+	}
+	if free == 0 {
+		return strings.Join(lines, "\n")
+	}
+
+	filters, _ := parms["pool/filter"].([]string)
+	if pinned, ok := parms["pool/machine-list"].([]string); ok && len(pinned) == 1 {
+		filters = append(append([]string{}, filters...), fmt.Sprintf("Uuid=Eq(%s)", pinned[0]))
+	}
+	for _, f := range filters {
+		count, err := r.countAvailable(rctx, pool, []string{f})
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("Filter %s: unable to count matching machines: %v", f, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("Filter %s eliminates %d of %d free machines.", f, free-count, free))
+	}
+	if len(filters) > 1 {
+		if count, err := r.countAvailable(rctx, pool, filters); err == nil {
+			lines = append(lines, fmt.Sprintf("%d free machines match all filters.", count))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,121 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+/*
+ * Encrypts the values for the machine with its secure param public key.
+ * The results can be set as params and are only readable by DRP.
+ */
+func (r *MachineResource) encryptParams(ctx context.Context, uuid string, values map[string]string) (map[string]interface{}, error) {
+	encrypted := map[string]interface{}{}
+	if len(values) == 0 {
+		return encrypted, nil
+	}
+	pubkey := []byte{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines", uuid, "pubkey").Do(&pubkey); err != nil {
+		return nil, fmt.Errorf("unable to get the secure param key of machine %s: %w", uuid, err)
+	}
+	for name, value := range values {
+		sd := &models.SecureData{}
+		if err := sd.Marshal(pubkey, value); err != nil {
+			return nil, fmt.Errorf("unable to encrypt param %s: %w", name, err)
+		}
+		encrypted[name] = sd
+	}
+	return encrypted, nil
+}
+
+/*
+ * Applies changes to secure_parameters in place.  Changed values are
+ * encrypted and set again, removed params are restored to the value
+ * they replaced.  Without recorded changes, e.g. after import, removed
+ * params are deleted.
+ */
+func (r *MachineResource) updateSecureParams(ctx context.Context, plan, state *MachineResourceModel, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	uuid := state.Id.ValueString()
+	planSecure, sdiags := secureAdditions(ctx, plan)
+	diags.Append(sdiags...)
+	stateSecure, sdiags := secureAdditions(ctx, state)
+	diags.Append(sdiags...)
+	if diags.HasError() {
+		return diags
+	}
+	tracked := changes != nil && !changes.Untracked
+
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return diags
+	}
+
+	set := map[string]string{}
+	for name, value := range planSecure {
+		if previous, ok := stateSecure[name]; !ok || previous != value {
+			set[name] = value
+		}
+	}
+	encrypted, err := r.encryptParams(ctx, uuid, set)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to set secure_parameters on machine %s", uuid), err.Error())
+		return diags
+	}
+	names := []string{}
+	for name := range encrypted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		previous, replaced := machine.Params[name]
+		var res interface{}
+		if err := r.session.Req().Context(ctx).Post(encrypted[name]).UrlFor("machines", uuid, "params", name).Do(&res); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to set param %s on machine %s", name, uuid), err.Error())
+			return diags
+		}
+		tflog.Debug(ctx, fmt.Sprintf("Set secure param %s on machine %s", name, uuid))
+		if tracked && changes.paramChange(name) == nil {
+			changes.Params = append(changes.Params, paramChange{Name: name, Replaced: replaced, Previous: previous})
+		}
+	}
+
+	for name := range stateSecure {
+		if _, ok := planSecure[name]; ok {
+			continue
+		}
+		var change *paramChange
+		if tracked {
+			change = changes.paramChange(name)
+		}
+		var res interface{}
+		var err error
+		if change != nil && change.Replaced {
+			err = r.session.Req().Context(ctx).Post(change.Previous).UrlFor("machines", uuid, "params", name).Do(&res)
+		} else {
+			err = r.session.Req().Context(ctx).Del().UrlFor("machines", uuid, "params", name).Do(&res)
+			if isNotFound(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			diags.AddError(fmt.Sprintf("Unable to remove secure param %s from machine %s", name, uuid), err.Error())
+			return diags
+		}
+		if change != nil {
+			changes.dropParamChange(name)
+		}
+	}
+	return diags
+}
@@ -0,0 +1,288 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// machineSchemaVersion is the version of the drp_machine schema
+const machineSchemaVersion = 1
+
+/*
+ * Upgrades state written before the schema was versioned.  That covers
+ * the legacy 2.x SDKv2 provider as well as earlier releases of this
+ * provider, so the prior state is read from its raw JSON rather than a
+ * fixed prior schema.
+ */
+func (r *MachineResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: {StateUpgrader: upgradeMachineStateV0},
+	}
+}
+
+// legacyAttributes maps attribute names used by earlier providers to the current names
+var legacyAttributes = map[string]string{
+	"decommission_workflow": "deallocate_workflow",
+	"machine_name":          "name",
+	"machine_address":       "address",
+	"machine_status":        "status",
+}
+
+/*
+ * Maps version 0 state into the current schema.  Attributes are matched
+ * by name after renaming legacy attributes, attributes that no longer
+ * exist are dropped and values are coerced into the current shape, e.g.
+ * a single string into a list.  Defaults that Create would set are
+ * filled in for attributes the old state did not have.
+ */
+func upgradeMachineStateV0(ctx context.Context, req resource.UpgradeStateRequest, resp *resource.UpgradeStateResponse) {
+	if req.RawState == nil || req.RawState.JSON == nil {
+		resp.Diagnostics.AddError("Unable to upgrade drp_machine state",
+			"The prior state is not in JSON format.  Upgrade with Terraform 0.13 or later, or remove the machine from state and import it.")
+		return
+	}
+	prior := map[string]interface{}{}
+	if err := json.Unmarshal(req.RawState.JSON, &prior); err != nil {
+		resp.Diagnostics.AddError("Unable to decode the prior drp_machine state", err.Error())
+		return
+	}
+	for old, name := range legacyAttributes {
+		if v, ok := prior[old]; ok {
+			if _, exists := prior[name]; !exists || prior[name] == nil {
+				prior[name] = v
+			}
+			delete(prior, old)
+		}
+	}
+
+	c := &conformer{blocks: map[string]bool{}}
+	for name := range resp.State.Schema.GetBlocks() {
+		c.blocks[name] = true
+	}
+	typ := resp.State.Schema.Type().TerraformType(ctx)
+	conformed := c.conform(prior, typ, path.Empty())
+	resp.Diagnostics.Append(c.diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	buf, err := json.Marshal(conformed)
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to encode the upgraded drp_machine state", err.Error())
+		return
+	}
+	val, err := tftypes.ValueFromJSON(buf, typ)
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to upgrade drp_machine state", err.Error())
+		return
+	}
+	resp.State.Raw = val
+
+	var data MachineResourceModel
+	resp.Diagnostics.Append(resp.State.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	setUpgradeDefaults(&data)
+	tflog.Info(ctx, fmt.Sprintf("Upgraded state of machine %s to schema version %d", data.Id.ValueString(), machineSchemaVersion))
+	resp.Diagnostics.Append(resp.State.Set(ctx, data)...)
+}
+
+/*
+ * Fills in the values Create and ImportState set for attributes that
+ * the prior state did not record.
+ */
+func setUpgradeDefaults(data *MachineResourceModel) {
+	defaults := []struct {
+		value *types.String
+		def   string
+	}{
+		{&data.Pool, "default"},
+		{&data.Timeout, "5m"},
+		{&data.OnFailure, onFailureError},
+		{&data.OnDestroy, onDestroyRelease},
+		{&data.Mode, modeProvision},
+	}
+	for _, d := range defaults {
+		if d.value.IsNull() || d.value.ValueString() == "" {
+			*d.value = types.StringValue(d.def)
+		}
+	}
+	if data.JobLogLines.IsNull() {
+		data.JobLogLines = types.Int64Value(defaultJobLogLines)
+	}
+	if data.FailureRetries.IsNull() {
+		data.FailureRetries = types.Int64Value(1)
+	}
+	if data.WaitForAvailable.IsNull() {
+		data.WaitForAvailable = types.BoolValue(false)
+	}
+}
+
+// conformer coerces prior state into the current schema, collecting the values it cannot convert
+type conformer struct {
+	// blocks are the root block names, which keep empty lists
+	blocks map[string]bool
+	diags  diag.Diagnostics
+}
+
+/*
+ * Coerces a decoded JSON value into the shape of the Terraform type.
+ * SDKv2 stores unset values as empty strings, lists and maps; those
+ * become null so they match unset configuration instead of planning a
+ * replacement.  Values that cannot be coerced are reported.
+ */
+func (c *conformer) conform(v interface{}, typ tftypes.Type, p path.Path) interface{} {
+	if v == nil {
+		if typ.Is(tftypes.List{}) && c.isBlock(p) {
+			// Absent list blocks are empty, as in the configuration.
+			return []interface{}{}
+		}
+		return nil
+	}
+	switch {
+	case typ.Is(tftypes.Object{}):
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			// Blocks stored as single element lists by SDKv2.
+			if l, ok := v.([]interface{}); ok && len(l) == 1 {
+				return c.conform(l[0], typ, p)
+			}
+			if l, ok := v.([]interface{}); ok && len(l) == 0 {
+				return nil
+			}
+			return c.invalid(v, p)
+		}
+		out := map[string]interface{}{}
+		for name, atyp := range typ.(tftypes.Object).AttributeTypes {
+			out[name] = c.conform(m[name], atyp, p.AtName(name))
+		}
+		return out
+	case typ.Is(tftypes.List{}), typ.Is(tftypes.Set{}):
+		var etyp tftypes.Type
+		if l, ok := typ.(tftypes.List); ok {
+			etyp = l.ElementType
+		} else {
+			etyp = typ.(tftypes.Set).ElementType
+		}
+		var l []interface{}
+		switch e := v.(type) {
+		case []interface{}:
+			l = e
+		case map[string]interface{}:
+			if !etyp.Is(tftypes.String) {
+				return c.invalid(v, p)
+			}
+			// Maps of params become "name: value" entries.
+			keys := []string{}
+			for k := range e {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				switch e[k].(type) {
+				case map[string]interface{}, []interface{}:
+					return c.invalid(v, p)
+				}
+				l = append(l, fmt.Sprintf("%s: %v", k, e[k]))
+			}
+		default:
+			l = []interface{}{v}
+		}
+		out := []interface{}{}
+		for i, e := range l {
+			if conformed := c.conform(e, etyp, p.AtListIndex(i)); conformed != nil {
+				out = append(out, conformed)
+			}
+		}
+		if len(out) == 0 && !c.isBlock(p) {
+			return nil
+		}
+		return out
+	case typ.Is(tftypes.Map{}):
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return c.invalid(v, p)
+		}
+		out := map[string]interface{}{}
+		for k, e := range m {
+			if conformed := c.conform(e, typ.(tftypes.Map).ElementType, p.AtMapKey(k)); conformed != nil {
+				out[k] = conformed
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case typ.Is(tftypes.String):
+		switch s := v.(type) {
+		case string:
+			if s == "" {
+				return nil
+			}
+			return s
+		case float64, bool:
+			return fmt.Sprint(s)
+		}
+	case typ.Is(tftypes.Number):
+		switch n := v.(type) {
+		case float64:
+			return n
+		case string:
+			if n == "" {
+				return nil
+			}
+			if f, err := strconv.ParseFloat(n, 64); err == nil {
+				return f
+			}
+		}
+	case typ.Is(tftypes.Bool):
+		switch b := v.(type) {
+		case bool:
+			return b
+		case string:
+			if b == "" {
+				return nil
+			}
+			if parsed, err := strconv.ParseBool(b); err == nil {
+				return parsed
+			}
+		}
+	}
+	return c.invalid(v, p)
+}
+
+/*
+ * Reports if the path is a root block.
+ */
+func (c *conformer) isBlock(p path.Path) bool {
+	steps := p.Steps()
+	if len(steps) != 1 {
+		return false
+	}
+	name, ok := steps[0].(path.PathStepAttributeName)
+	return ok && c.blocks[string(name)]
+}
+
+/*
+ * Reports a value that cannot be converted to the current schema.
+ */
+func (c *conformer) invalid(v interface{}, p path.Path) interface{} {
+	buf, _ := json.Marshal(v)
+	c.diags.AddAttributeError(p, "Unable to upgrade drp_machine state",
+		fmt.Sprintf("The prior value %s cannot be converted to the current schema.  Fix the value in the state, or remove the machine from state and import it.", buf))
+	return nil
+}
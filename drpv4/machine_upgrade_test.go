@@ -0,0 +1,133 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+/*
+ * Runs the version 0 upgrader on raw state JSON.
+ */
+func upgradeV0(t *testing.T, raw []byte) *resource.UpgradeStateResponse {
+	t.Helper()
+	ctx := context.Background()
+	sresp := &resource.SchemaResponse{}
+	(&MachineResource{}).Schema(ctx, resource.SchemaRequest{}, sresp)
+	if sresp.Diagnostics.HasError() {
+		t.Fatalf("schema: %v", sresp.Diagnostics)
+	}
+	req := resource.UpgradeStateRequest{RawState: &tfprotov6.RawState{JSON: raw}}
+	resp := &resource.UpgradeStateResponse{State: tfsdk.State{Schema: sresp.Schema}}
+	upgradeMachineStateV0(ctx, req, resp)
+	return resp
+}
+
+func TestUpgradeMachineStateV2(t *testing.T) {
+	ctx := context.Background()
+	raw, err := os.ReadFile("testdata/machine_state_v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := upgradeV0(t, raw)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("upgrade: %v", resp.Diagnostics)
+	}
+	var data MachineResourceModel
+	if diags := resp.State.Get(ctx, &data); diags.HasError() {
+		t.Fatalf("get: %v", diags)
+	}
+
+	strs := map[string]struct {
+		got  string
+		null bool
+		want string
+	}{
+		"id":                  {data.Id.ValueString(), data.Id.IsNull(), "3f2504e0-4f89-11d3-9a0c-0305e82c3301"},
+		"pool":                {data.Pool.ValueString(), data.Pool.IsNull(), "k8s"},
+		"timeout":             {data.Timeout.ValueString(), data.Timeout.IsNull(), "20m"},
+		"deallocate_workflow": {data.DeallocateWorkflow.ValueString(), data.DeallocateWorkflow.IsNull(), "discover-base"},
+		"name":                {data.Name.ValueString(), data.Name.IsNull(), "d52-54-00-12-34-56"},
+		"address":             {data.Address.ValueString(), data.Address.IsNull(), "10.10.1.21"},
+		"on_failure":          {data.OnFailure.ValueString(), data.OnFailure.IsNull(), onFailureError},
+		"on_destroy":          {data.OnDestroy.ValueString(), data.OnDestroy.IsNull(), onDestroyRelease},
+		"mode":                {data.Mode.ValueString(), data.Mode.IsNull(), modeProvision},
+	}
+	for name, s := range strs {
+		if s.null || s.got != s.want {
+			t.Errorf("%s = %q (null %v), want %q", name, s.got, s.null, s.want)
+		}
+	}
+	if !data.AllocateWorkflow.IsNull() {
+		t.Errorf("allocate_workflow = %s, want null for an empty string", data.AllocateWorkflow)
+	}
+	for name, null := range map[string]bool{
+		"add_profiles":    data.AddProfiles.IsNull(),
+		"filters":         data.Filters.IsNull(),
+		"default_filters": data.DefaultFilters.IsNull(),
+	} {
+		if !null {
+			t.Errorf("%s is not null for an empty list", name)
+		}
+	}
+	if data.Filter.IsNull() || len(data.Filter.Elements()) != 0 {
+		t.Errorf("filter = %s, want an empty block list", data.Filter)
+	}
+
+	params := []string{}
+	data.AddParameters.ElementsAs(ctx, &params, false)
+	want := []string{"os-install/hostname-prefix: web", "universal/application: ubuntu-20.04"}
+	if len(params) != len(want) || params[0] != want[0] || params[1] != want[1] {
+		t.Errorf("add_parameters = %v, want %v", params, want)
+	}
+	if n := len(data.AuthorizedKeys.Elements()); n != 1 {
+		t.Errorf("authorized_keys has %d keys, want 1", n)
+	}
+	if data.JobLogLines.ValueInt64() != defaultJobLogLines || data.FailureRetries.ValueInt64() != 1 {
+		t.Errorf("job_log_lines %d failure_retries %d, want defaults", data.JobLogLines.ValueInt64(), data.FailureRetries.ValueInt64())
+	}
+}
+
+func TestUpgradeMachineStateLegacyNames(t *testing.T) {
+	ctx := context.Background()
+	resp := upgradeV0(t, []byte(`{"id":"m1","pool":"default","decommission_workflow":"discover-base","machine_name":"web-1","machine_address":"10.0.0.5","machine_status":"InUse"}`))
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("upgrade: %v", resp.Diagnostics)
+	}
+	var data MachineResourceModel
+	if diags := resp.State.Get(ctx, &data); diags.HasError() {
+		t.Fatalf("get: %v", diags)
+	}
+	if data.DeallocateWorkflow.ValueString() != "discover-base" || data.Name.ValueString() != "web-1" ||
+		data.Address.ValueString() != "10.0.0.5" || data.Status.ValueString() != "InUse" {
+		t.Errorf("legacy names not mapped: deallocate_workflow %s name %s address %s status %s",
+			data.DeallocateWorkflow, data.Name, data.Address, data.Status)
+	}
+}
+
+func TestUpgradeMachineStateInvalid(t *testing.T) {
+	resp := upgradeV0(t, []byte(`{"id":"m1","failure_retries":"many","add_parameters":{"nested":{"a":1}}}`))
+	if !resp.Diagnostics.HasError() {
+		t.Fatal("expected errors for values that cannot be converted")
+	}
+	reported := map[string]bool{}
+	for _, d := range resp.Diagnostics.Errors() {
+		if wp, ok := d.(interface{ Path() path.Path }); ok {
+			reported[wp.Path().String()] = true
+		}
+	}
+	for _, name := range []string{"failure_retries", "add_parameters"} {
+		if !reported[name] {
+			t.Errorf("no error reported for %s, got %v", name, resp.Diagnostics)
+		}
+	}
+}
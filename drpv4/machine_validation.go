@@ -0,0 +1,347 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// maxSuggestions is the number of close matches offered for a misspelled name
+const maxSuggestions = 3
+
+/*
+ * Checks the static format of the configuration.  Lookups against the
+ * DRP endpoint happen in ModifyPlan, once the provider is configured.
+ */
+func (r *MachineResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data MachineResourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if !data.Machine.IsNull() && data.OnFailure.ValueString() == onFailureReplace {
+		resp.Diagnostics.AddAttributeError(path.Root("on_failure"),
+			"on_failure replace cannot be used with machine",
+			"A pinned machine cannot be replaced by a different machine.  Use error or retry_workflow.")
+	}
+
+	if data.OnFailure.ValueString() == onFailureReplace && data.QuarantinePool.IsNull() {
+		resp.Diagnostics.AddAttributeError(path.Root("quarantine_pool"),
+			"quarantine_pool is required when on_failure is replace",
+			"A failed machine released back to the pool can be allocated again as its own replacement.  Set quarantine_pool to the pool failed machines are moved to.")
+	}
+	if !data.QuarantinePool.IsNull() && !data.QuarantinePool.IsUnknown() && !data.Pool.IsUnknown() {
+		pool := data.Pool.ValueString()
+		if pool == "" {
+			pool = "default"
+		}
+		if data.QuarantinePool.ValueString() == pool {
+			resp.Diagnostics.AddAttributeError(path.Root("quarantine_pool"),
+				"quarantine_pool must differ from pool",
+				"Machines quarantined in the pool they were allocated from can be allocated again.")
+		}
+	}
+
+	if data.SpreadBy.IsNull() != data.PlacementGroup.IsNull() {
+		resp.Diagnostics.AddAttributeError(path.Root("spread_by"),
+			"spread_by and placement_group must be set together",
+			"Machines are spread across the spread_by values used by the other machines of the placement_group.")
+	}
+
+	if data.OnDestroy.ValueString() == onDestroyWipe && (data.WipeWorkflow.IsNull() || (!data.WipeWorkflow.IsUnknown() && data.WipeWorkflow.ValueString() == "")) {
+		resp.Diagnostics.AddAttributeError(path.Root("wipe_workflow"),
+			"wipe_workflow is required when on_destroy is wipe",
+			"Set wipe_workflow to the workflow that wipes the disks of the machine.")
+	}
+
+	if !data.Filter.IsUnknown() {
+		blocks := []FilterModel{}
+		resp.Diagnostics.Append(data.Filter.ElementsAs(ctx, &blocks, false)...)
+		for i, f := range blocks {
+			resp.Diagnostics.Append(f.validate(path.Root("filter").AtListIndex(i))...)
+		}
+	}
+
+	for i, elem := range data.AuthorizedKeys.Elements() {
+		k, ok := elem.(types.String)
+		if !ok || k.IsUnknown() || k.IsNull() {
+			continue
+		}
+		if _, err := accessKeyName(k.ValueString()); err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("authorized_keys").AtListIndex(i),
+				"authorized_key format not correct", err.Error())
+		}
+	}
+
+	for name, list := range map[string]types.List{
+		"add_parameters":        data.AddParameters,
+		"deallocate_parameters": data.DeallocateParameters,
+	} {
+		for i, elem := range list.Elements() {
+			p, ok := elem.(types.String)
+			if !ok || p.IsUnknown() || p.IsNull() {
+				continue
+			}
+			if !strings.Contains(p.ValueString(), ":") {
+				resp.Diagnostics.AddAttributeError(path.Root(name).AtListIndex(i),
+					fmt.Sprintf("%s format not correct", strings.TrimSuffix(name, "s")),
+					fmt.Sprintf("Expected \"param: value\", got %q", p.ValueString()))
+			}
+		}
+	}
+}
+
+// objectIndex caches the names of objects on the DRP endpoint during a plan
+type objectIndex struct {
+	r      *MachineResource
+	names  map[string][]string
+	secure map[string]bool
+}
+
+/*
+ * Returns the names of all objects of a type.
+ */
+func (idx *objectIndex) list(ctx context.Context, prefix string) ([]string, error) {
+	if names, ok := idx.names[prefix]; ok {
+		return names, nil
+	}
+	objs := []struct {
+		Id     string
+		Name   string
+		Secure bool
+	}{}
+	if err := idx.r.session.Req().Context(ctx).UrlFor(prefix).Params("slim", "Params,Meta").Do(&objs); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, o := range objs {
+		if o.Name != "" {
+			names = append(names, o.Name)
+		} else {
+			names = append(names, o.Id)
+		}
+		if prefix == "params" && o.Secure {
+			idx.secure[o.Name] = true
+		}
+	}
+	idx.names[prefix] = names
+	return names, nil
+}
+
+/*
+ * Checks that an object exists and adds a diagnostic with close matches
+ * to the attribute when it does not.  Missing params are reported as
+ * warnings, since DRP allows params without a definition.
+ */
+func (idx *objectIndex) check(ctx context.Context, diags *diag.Diagnostics, at path.Path, prefix, kind, name string) {
+	names, err := idx.list(ctx, prefix)
+	if err != nil {
+		diags.AddAttributeWarning(at, fmt.Sprintf("Unable to list %s to validate %s %s", prefix, kind, name), err.Error())
+		return
+	}
+	for _, n := range names {
+		if n == name {
+			return
+		}
+	}
+	summary := fmt.Sprintf("%s %s does not exist on the DRP endpoint", kind, name)
+	detail := ""
+	if matches := closeMatches(name, names); len(matches) > 0 {
+		detail = fmt.Sprintf("Did you mean %s?", strings.Join(matches, ", "))
+	}
+	if prefix == "params" {
+		diags.AddAttributeWarning(at, summary, detail)
+	} else {
+		diags.AddAttributeError(at, summary, detail)
+	}
+}
+
+/*
+ * Checks that a secure_parameters key is a param defined with Secure
+ * set.  Anything else would be stored in the clear or rejected by DRP
+ * once the machine is allocated, so both cases are errors.
+ */
+func (idx *objectIndex) checkSecure(ctx context.Context, diags *diag.Diagnostics, at path.Path, name string) {
+	names, err := idx.list(ctx, "params")
+	if err != nil {
+		diags.AddAttributeWarning(at, fmt.Sprintf("Unable to list params to validate secure param %s", name), err.Error())
+		return
+	}
+	if idx.secure[name] {
+		return
+	}
+	for _, n := range names {
+		if n == name {
+			diags.AddAttributeError(at, fmt.Sprintf("param %s is not a secure param", name),
+				"secure_parameters may only set params defined with Secure: true; use add_parameters for other params")
+			return
+		}
+	}
+	detail := "secure_parameters may only set params defined with Secure: true"
+	if matches := closeMatches(name, names); len(matches) > 0 {
+		detail = fmt.Sprintf("%s.  Did you mean %s?", detail, strings.Join(matches, ", "))
+	}
+	diags.AddAttributeError(at, fmt.Sprintf("param %s does not exist on the DRP endpoint", name), detail)
+}
+
+/*
+ * Checks that the pools, workflows, profiles and params referenced by
+ * the plan exist.  Only values that changed from the state are checked,
+ * so objects removed after allocation do not block later plans.
+ */
+func (r *MachineResource) validatePlan(ctx context.Context, plan, state *MachineResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if r.session == nil {
+		return diags
+	}
+	if state == nil {
+		state = &MachineResourceModel{Filter: types.ListNull(filterType)}
+	}
+	idx := &objectIndex{r: r, names: map[string][]string{}, secure: map[string]bool{}}
+
+	strs := []struct {
+		name, prefix, kind string
+		plan, state        types.String
+	}{
+		{"pool", "pools", "pool", plan.Pool, state.Pool},
+		{"quarantine_pool", "pools", "pool", plan.QuarantinePool, state.QuarantinePool},
+		{"allocate_workflow", "workflows", "workflow", plan.AllocateWorkflow, state.AllocateWorkflow},
+		{"deallocate_workflow", "workflows", "workflow", plan.DeallocateWorkflow, state.DeallocateWorkflow},
+		{"wipe_workflow", "workflows", "workflow", plan.WipeWorkflow, state.WipeWorkflow},
+	}
+	for _, s := range strs {
+		if s.plan.IsUnknown() || s.plan.IsNull() || s.plan.ValueString() == "" || s.plan.Equal(s.state) {
+			continue
+		}
+		idx.check(ctx, &diags, path.Root(s.name), s.prefix, s.kind, s.plan.ValueString())
+	}
+
+	lists := []struct {
+		name, prefix, kind string
+		plan, state        types.List
+		key                func(string) string
+	}{
+		{"add_profiles", "profiles", "profile", plan.AddProfiles, state.AddProfiles, nil},
+		{"deallocate_profiles", "profiles", "profile", plan.DeallocateProfiles, state.DeallocateProfiles, nil},
+		{"add_parameters", "params", "param", plan.AddParameters, state.AddParameters, paramName},
+		{"deallocate_parameters", "params", "param", plan.DeallocateParameters, state.DeallocateParameters, paramName},
+		{"read_parameters", "params", "param", plan.ReadParameters, state.ReadParameters, nil},
+	}
+	for _, l := range lists {
+		if l.plan.IsUnknown() || l.plan.IsNull() || l.plan.Equal(l.state) {
+			continue
+		}
+		for i, elem := range l.plan.Elements() {
+			v, ok := elem.(types.String)
+			if !ok || v.IsUnknown() || v.IsNull() {
+				continue
+			}
+			name := v.ValueString()
+			if l.key != nil {
+				name = l.key(name)
+			}
+			idx.check(ctx, &diags, path.Root(l.name).AtListIndex(i), l.prefix, l.kind, name)
+		}
+	}
+	if !plan.WorkOrders.IsUnknown() && !plan.WorkOrders.Equal(state.WorkOrders) {
+		orders := []WorkOrderModel{}
+		diags.Append(plan.WorkOrders.ElementsAs(ctx, &orders, false)...)
+		for i, order := range orders {
+			if order.Blueprint.IsUnknown() || order.Blueprint.IsNull() {
+				continue
+			}
+			idx.check(ctx, &diags, path.Root("work_orders").AtListIndex(i).AtName("blueprint"), "blueprints", "blueprint", order.Blueprint.ValueString())
+		}
+	}
+	if !plan.SecureParameters.IsUnknown() && !plan.SecureParameters.Equal(state.SecureParameters) {
+		for name := range plan.SecureParameters.Elements() {
+			idx.checkSecure(ctx, &diags, path.Root("secure_parameters").AtMapKey(name), name)
+		}
+	}
+	idx.checkFilterFields(ctx, &diags, plan.Filter, state.Filter)
+	return diags
+}
+
+/*
+ * Returns the param name of a "param: value" entry.
+ */
+func paramName(p string) string {
+	return strings.TrimSpace(strings.SplitN(p, ":", 2)[0])
+}
+
+/*
+ * Returns the names closest to name by edit distance.
+ */
+func closeMatches(name string, names []string) []string {
+	limit := len(name) / 3
+	if limit < 2 {
+		limit = 2
+	}
+	type match struct {
+		name string
+		dist int
+	}
+	matches := []match{}
+	for _, n := range names {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(n)); d <= limit {
+			matches = append(matches, match{n, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+	res := []string{}
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		res = append(res, matches[i].name)
+	}
+	return res
+}
+
+/*
+ * Returns the Levenshtein distance between two strings.
+ */
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
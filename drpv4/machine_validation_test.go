@@ -0,0 +1,35 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+)
+
+func TestCheckSecure(t *testing.T) {
+	idx := &objectIndex{
+		names:  map[string][]string{"params": {"api-key", "hostname"}},
+		secure: map[string]bool{"api-key": true},
+	}
+	tests := []struct {
+		name  string
+		error bool
+	}{
+		{"api-key", false},
+		{"hostname", true},
+		{"api-kye", true},
+	}
+	for _, tt := range tests {
+		var diags diag.Diagnostics
+		idx.checkSecure(context.Background(), &diags, path.Root("secure_parameters").AtMapKey(tt.name), tt.name)
+		if diags.HasError() != tt.error {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.error, diags)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"gitlab.com/rackn/provision/v4/models"
+)
+
+// WorkOrderModel describes a blueprint run on the machine as a work order.
+type WorkOrderModel struct {
+	Blueprint types.String `tfsdk:"blueprint"`
+	Params    types.Map    `tfsdk:"params"`
+}
+
+// WorkOrderResultModel describes a work order submitted by the provider.
+type WorkOrderResultModel struct {
+	Uuid      types.String `tfsdk:"uuid"`
+	Blueprint types.String `tfsdk:"blueprint"`
+	State     types.String `tfsdk:"state"`
+}
+
+var workOrderResultType = types.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"uuid":      types.StringType,
+		"blueprint": types.StringType,
+		"state":     types.StringType,
+	},
+}
+
+/*
+ * Reports if a work order is done running.
+ */
+func workOrderDone(state string) bool {
+	switch state {
+	case "finished", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+/*
+ * Puts the machine in work order mode so it runs the submitted work
+ * orders.  The previous mode is recorded so release can restore it.
+ */
+func (r *MachineResource) enableWorkOrders(ctx context.Context, uuid string, changes *machineChanges) error {
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if machine.WorkOrderMode && machine.Runnable {
+		return nil
+	}
+	if changes != nil && changes.WorkOrderMode == nil {
+		previous := machine.WorkOrderMode
+		changes.WorkOrderMode = &previous
+	}
+	updated := models.Clone(machine).(*models.Machine)
+	updated.WorkOrderMode = true
+	updated.Runnable = true
+	return r.patchMachine(ctx, machine, updated)
+}
+
+/*
+ * Restores the work order mode recorded before allocation.
+ */
+func (r *MachineResource) revertWorkOrderMode(ctx context.Context, uuid string, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if changes == nil || changes.WorkOrderMode == nil {
+		return diags
+	}
+	machine, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return diags
+	}
+	if machine.WorkOrderMode != *changes.WorkOrderMode {
+		updated := models.Clone(machine).(*models.Machine)
+		updated.WorkOrderMode = *changes.WorkOrderMode
+		if err := r.patchMachine(ctx, machine, updated); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to restore the work order mode of machine %s", uuid), err.Error())
+			return diags
+		}
+	}
+	changes.WorkOrderMode = nil
+	return diags
+}
+
+/*
+ * Submits the work orders of the plan to the machine one at a time and
+ * waits for each to finish.  The results are recorded on the plan; a
+ * failed work order stops the rest from being submitted.
+ */
+func (r *MachineResource) runWorkOrders(ctx context.Context, plan *MachineResourceModel, changes *machineChanges) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	uuid := plan.Id.ValueString()
+	orders := []WorkOrderModel{}
+	diags.Append(plan.WorkOrders.ElementsAs(ctx, &orders, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	results := []WorkOrderResultModel{}
+	defer func() {
+		var d diag.Diagnostics
+		plan.WorkOrderResults, d = types.ListValueFrom(ctx, workOrderResultType, results)
+		diags.Append(d...)
+	}()
+	if len(orders) == 0 {
+		return diags
+	}
+
+	if err := r.enableWorkOrders(ctx, uuid, changes); err != nil {
+		diags.AddError(fmt.Sprintf("Unable to put machine %s in work order mode", uuid), err.Error())
+		return diags
+	}
+
+	for _, order := range orders {
+		params := map[string]string{}
+		diags.Append(order.Params.ElementsAs(ctx, &params, false)...)
+		if diags.HasError() {
+			return diags
+		}
+		blueprint := order.Blueprint.ValueString()
+		req := map[string]interface{}{
+			"Blueprint": blueprint,
+			"Machine":   uuid,
+			"Params":    params,
+		}
+		wo := &models.WorkOrder{}
+		if err := r.session.Req().Context(ctx).Post(req).UrlFor("work_orders").Do(wo); err != nil {
+			diags.AddError(fmt.Sprintf("Unable to submit blueprint %s to machine %s", blueprint, uuid), err.Error())
+			return diags
+		}
+		id := wo.Uuid.String()
+		tflog.Info(ctx, fmt.Sprintf("Submitted work order %s running blueprint %s on machine %s", id, blueprint, uuid))
+
+		wo, err := r.waitForWorkOrder(ctx, id)
+		result := WorkOrderResultModel{
+			Uuid:      types.StringValue(id),
+			Blueprint: types.StringValue(blueprint),
+			State:     types.StringValue(wo.State),
+		}
+		results = append(results, result)
+		if err != nil {
+			diags.AddError(fmt.Sprintf("Work order %s running blueprint %s did not finish", id, blueprint), err.Error())
+			return diags
+		}
+		if wo.State != "finished" {
+			diags.AddError(
+				fmt.Sprintf("Work order %s running blueprint %s on machine %s is %s", id, blueprint, uuid, wo.State),
+				r.holdBuildDetail(ctx, uuid, int(plan.JobLogLines.ValueInt64())))
+			return diags
+		}
+	}
+	return diags
+}
+
+/*
+ * Waits for a work order to finish, fail or be cancelled.  Returns the
+ * last known work order when the context deadline passes.
+ */
+func (r *MachineResource) waitForWorkOrder(ctx context.Context, uuid string) (*models.WorkOrder, error) {
+	wo := &models.WorkOrder{}
+	for {
+		next := &models.WorkOrder{}
+		if err := r.session.Req().Context(ctx).UrlFor("work_orders", uuid).Do(next); err != nil {
+			if ctx.Err() != nil {
+				return wo, fmt.Errorf("gave up waiting for work order %s: %w", uuid, ctx.Err())
+			}
+			return wo, err
+		}
+		wo = next
+		if workOrderDone(wo.State) {
+			return wo, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return wo, fmt.Errorf("gave up waiting for work order %s in state %s: %w", uuid, wo.State, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
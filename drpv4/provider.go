@@ -21,6 +21,7 @@ import (
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"gitlab.com/rackn/provision/v4/api"
+	"gitlab.com/rackn/provision/v4/models"
 )
 
 // Ensure ScaffoldingProvider satisfies various provider interfaces.
@@ -185,8 +186,8 @@ func (p *Config) Configure(ctx context.Context, req provider.ConfigureRequest, r
 		return
 	}
 
-	info, err := p.session.Info()
-	if err != nil {
+	info := &models.Info{}
+	if err := p.session.Req().Context(ctx).UrlFor("info").Do(info); err != nil {
 		resp.Diagnostics.AddError("Failed to Connect", fmt.Sprint("Failed to fetch info for ", p.endpoint))
 		return
 	}
@@ -7,14 +7,22 @@ package drpv4
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/boolplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"gitlab.com/rackn/provision/v4/api"
@@ -24,6 +32,9 @@ import (
 // Ensure provider defined types fully satisfy framework interfaces.
 var _ resource.Resource = &MachineResource{}
 var _ resource.ResourceWithImportState = &MachineResource{}
+var _ resource.ResourceWithModifyPlan = &MachineResource{}
+var _ resource.ResourceWithValidateConfig = &MachineResource{}
+var _ resource.ResourceWithUpgradeState = &MachineResource{}
 
 func NewMachineResource() resource.Resource {
 	return &MachineResource{}
@@ -39,19 +50,59 @@ type MachineResourceModel struct {
 	Id types.String `tfsdk:"id"`
 
 	Pool                 types.String `tfsdk:"pool"`
+	Machine              types.String `tfsdk:"machine"`
 	AllocateWorkflow     types.String `tfsdk:"allocate_workflow"`
 	DeallocateWorkflow   types.String `tfsdk:"deallocate_workflow"`
 	Timeout              types.String `tfsdk:"timeout"`
 	AddProfiles          types.List   `tfsdk:"add_profiles"`
 	AddParameters        types.List   `tfsdk:"add_parameters"`
+	SecureParameters     types.Map    `tfsdk:"secure_parameters"`
 	Filters              types.List   `tfsdk:"filters"`
+	Filter               types.List   `tfsdk:"filter"`
+	DefaultFilters       types.List   `tfsdk:"default_filters"`
 	AuthorizedKeys       types.List   `tfsdk:"authorized_keys"`
 	DeallocateProfiles   types.List   `tfsdk:"deallocate_profiles"`
 	DeallocateParameters types.List   `tfsdk:"deallocate_parameters"`
+	JobLogLines          types.Int64  `tfsdk:"job_log_lines"`
+	OnFailure            types.String `tfsdk:"on_failure"`
+	FailureRetries       types.Int64  `tfsdk:"failure_retries"`
+	QuarantinePool       types.String `tfsdk:"quarantine_pool"`
+	OnDestroy            types.String `tfsdk:"on_destroy"`
+	Mode                 types.String `tfsdk:"mode"`
+	WipeWorkflow         types.String `tfsdk:"wipe_workflow"`
+	PowerState           types.String `tfsdk:"power_state"`
+	PowerCycleTrigger    types.String `tfsdk:"power_cycle_trigger"`
+	SpreadBy             types.String `tfsdk:"spread_by"`
+	PlacementGroup       types.String `tfsdk:"placement_group"`
+	Hostname             types.String `tfsdk:"hostname"`
+	Description          types.String `tfsdk:"description"`
+	Meta                 types.Map    `tfsdk:"meta"`
+	WorkOrders           types.List   `tfsdk:"work_orders"`
+	WaitForAvailable     types.Bool   `tfsdk:"wait_for_available"`
+	AvailabilityTimeout  types.String `tfsdk:"availability_timeout"`
 
-	Address types.String `tfsdk:"address"`
-	Name    types.String `tfsdk:"name"`
-	Status  types.String `tfsdk:"status"`
+	ReadParameters types.List `tfsdk:"read_parameters"`
+
+	Timeouts   *TimeoutsModel   `tfsdk:"timeouts"`
+	ReadyCheck *ReadyCheckModel `tfsdk:"ready_check"`
+
+	ConnectionParams *ConnectionParamsModel `tfsdk:"connection_params"`
+	ConnectionInfo   types.Object           `tfsdk:"connection_info"`
+
+	Address          types.String `tfsdk:"address"`
+	Name             types.String `tfsdk:"name"`
+	Status           types.String `tfsdk:"status"`
+	Arch             types.String `tfsdk:"arch"`
+	BootEnv          types.String `tfsdk:"boot_env"`
+	Workflow         types.String `tfsdk:"workflow"`
+	Stage            types.String `tfsdk:"stage"`
+	CurrentTask      types.String `tfsdk:"current_task"`
+	HardwareAddrs    types.List   `tfsdk:"hardware_addrs"`
+	Interfaces       types.List   `tfsdk:"interfaces"`
+	Profiles         types.List   `tfsdk:"profiles"`
+	MachineMeta      types.Map    `tfsdk:"machine_meta"`
+	WorkOrderResults types.List   `tfsdk:"work_order_results"`
+	Parameters       types.Map    `tfsdk:"parameters"`
 }
 
 func (r *MachineResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
@@ -62,6 +113,7 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 	resp.Schema = schema.Schema{
 		// This description is used by the documentation generator and the language server.
 		MarkdownDescription: "Machine resource",
+		Version:             machineSchemaVersion,
 
 		Attributes: map[string]schema.Attribute{
 			"id": schema.StringAttribute{
@@ -80,8 +132,15 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 					stringplanmodifier.RequiresReplace(),
 				},
 			},
+			"machine": schema.StringAttribute{
+				MarkdownDescription: "Name or UUID of a specific machine to allocate from the pool",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
 			"allocate_workflow": schema.StringAttribute{
-				MarkdownDescription: "Workflow to run when the machine is allocated in the pool",
+				MarkdownDescription: "Workflow to run when the machine is allocated in the pool.  It runs once the params, profiles and keys are set and must finish within the create timeout.  Defaults to the allocate workflow of the pool, which is not started by the pool itself.",
 				Optional:            true,
 				PlanModifiers: []planmodifier.String{
 					stringplanmodifier.RequiresReplace(),
@@ -96,15 +155,19 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 			},
 			"timeout": schema.StringAttribute{
 				Computed:            true,
-				MarkdownDescription: "Maximum time to wait for the machine to complete transition.  Time string format.",
+				DeprecationMessage:  "Use the timeouts block instead.",
+				MarkdownDescription: "Maximum time to wait for the machine to complete transition.  Time string format.  Used when the timeouts block does not set the operation.",
 				Optional:            true,
 				PlanModifiers: []planmodifier.String{
-					stringplanmodifier.RequiresReplace(),
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					durationValidator{},
 				},
 			},
 			"add_profiles": schema.ListAttribute{
 				ElementType:         types.StringType,
-				MarkdownDescription: "List of profiles to add to the machine when allocating.  Profiles are removed on release.",
+				MarkdownDescription: "List of profiles to add to the machine when allocating.  Profiles the machine did not already have are removed on release.",
 				Optional:            true,
 				PlanModifiers: []planmodifier.List{
 					listplanmodifier.RequiresReplace(),
@@ -112,12 +175,18 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 			},
 			"add_parameters": schema.ListAttribute{
 				ElementType:         types.StringType,
-				MarkdownDescription: "List of parameters to add to the machine when allocating.  Parameters are removed on release.",
+				MarkdownDescription: "List of parameters to add to the machine when allocating.  On release, parameters the machine did not already have are removed and replaced values are restored.",
 				Optional:            true,
 				PlanModifiers: []planmodifier.List{
 					listplanmodifier.RequiresReplace(),
 				},
 			},
+			"secure_parameters": schema.MapAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "Map of secure parameters to add to the machine when allocating.  Keys must be params defined with `Secure: true`.  Values are encrypted for the machine before they are set.  Changes are applied in place, e.g. after import, where the values cannot be read back.  On release, parameters the machine did not already have are removed and replaced values are restored.",
+				Optional:            true,
+				Sensitive:           true,
+			},
 			"deallocate_profiles": schema.ListAttribute{
 				ElementType:         types.StringType,
 				MarkdownDescription: "List of profiles to add to the machine when deallocating.",
@@ -142,14 +211,56 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 					listplanmodifier.RequiresReplace(),
 				},
 			},
-			"authorized_keys": schema.ListAttribute{
+			"default_filters": schema.ListAttribute{
 				ElementType:         types.StringType,
-				MarkdownDescription: "List of ssh public keys that should be added to the access-keys parameter on the machine.",
+				MarkdownDescription: "Replaces the default filters Runnable=Eq(true), WorkflowComplete=Eq(true) and WorkOrderMode=Eq(false) applied when searching for a machine.  Set to [] to search all machines.",
 				Optional:            true,
 				PlanModifiers: []planmodifier.List{
 					listplanmodifier.RequiresReplace(),
 				},
 			},
+			"authorized_keys": schema.ListAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "List of ssh public keys that should be merged into the access-keys parameter on the machine.  Keys are named after their fingerprint, changes are applied in place and only the keys Terraform added are removed on release.",
+				Optional:            true,
+			},
+			"job_log_lines": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "Number of lines of the failed job log to include when the machine is stuck in HoldBuild.  Defaults to 20, 0 disables the log.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"on_failure": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Action to take when the machine lands in HoldBuild: `error` reports the failure, `retry_workflow` restarts the allocate workflow and `replace` releases the machine and allocates another.  Defaults to `error`.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					stringvalidator.OneOf(onFailureError, onFailureRetryWorkflow, onFailureReplace),
+				},
+			},
+			"failure_retries": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "Number of times the on_failure policy is applied before giving up.  Defaults to 1.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"quarantine_pool": schema.StringAttribute{
+				MarkdownDescription: "Pool to move machines that failed in HoldBuild to after they are released by the `replace` policy.  Required with `replace` so the failed machine cannot be allocated again, and must differ from pool.",
+				Optional:            true,
+			},
 			"address": schema.StringAttribute{
 				Computed:            true,
 				MarkdownDescription: "Returns the IP address on the machine, Machine.Address field",
@@ -162,6 +273,231 @@ func (r *MachineResource) Schema(ctx context.Context, req resource.SchemaRequest
 				Computed:            true,
 				MarkdownDescription: "Returns the Name of the machine, Machine.Name field",
 			},
+			"on_destroy": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "How the machine is handled on destroy: `release` returns it to the pool, `wipe` runs wipe_workflow and waits for it to finish before release, `deregister` deletes the machine after release and `retain` drops it from state without touching DRP.  Defaults to `release`.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					stringvalidator.OneOf(onDestroyRelease, onDestroyWipe, onDestroyDeregister, onDestroyRetain),
+				},
+			},
+			"mode": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "`provision` runs allocate_workflow after the machine is allocated, `reserve` only claims the machine and leaves its workflow, work orders and ready_check alone.  Switching from `reserve` to `provision` applies allocate_workflow in place, switching back replaces the machine.  Defaults to `provision`.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					stringvalidator.OneOf(modeProvision, modeReserve),
+				},
+			},
+			"wipe_workflow": schema.StringAttribute{
+				MarkdownDescription: "Workflow that wipes the disks of the machine when on_destroy is `wipe`",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.LengthAtLeast(1),
+				},
+			},
+			"power_state": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Power state of the machine, `on` or `off`.  Changes are applied through the IPMI or Redfish plugin actions of the machine.  When not set, the current power state is reported.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					stringvalidator.OneOf(powerOn, powerOff),
+				},
+			},
+			"hostname": schema.StringAttribute{
+				MarkdownDescription: "Name to give the machine after allocation.  The original name is restored on release.",
+				Optional:            true,
+			},
+			"description": schema.StringAttribute{
+				MarkdownDescription: "Description to give the machine after allocation.  The original description is restored on release.",
+				Optional:            true,
+			},
+			"meta": schema.MapAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "Meta labels to set on the machine after allocation.  The original values are restored on release.",
+				Optional:            true,
+			},
+			"work_orders": schema.ListNestedAttribute{
+				MarkdownDescription: "Blueprints to run on the machine as work orders after allocation.  The machine is put in work order mode and each work order is waited on in turn.  Changing the list submits the work orders again.",
+				Optional:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"blueprint": schema.StringAttribute{
+							MarkdownDescription: "Name of the blueprint to run",
+							Required:            true,
+						},
+						"params": schema.MapAttribute{
+							ElementType:         types.StringType,
+							MarkdownDescription: "Params of the work order",
+							Optional:            true,
+						},
+					},
+				},
+			},
+			"spread_by": schema.StringAttribute{
+				MarkdownDescription: "Machine param or field, e.g. `rack` or `zone`, whose values the machines of placement_group are spread across",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"placement_group": schema.StringAttribute{
+				MarkdownDescription: "Name of the placement group of the machine.  Machines sharing a group are allocated on distinct spread_by values while free machines allow it.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"power_cycle_trigger": schema.StringAttribute{
+				MarkdownDescription: "Arbitrary value that power cycles the machine whenever it changes, e.g. after firmware updates.",
+				Optional:            true,
+			},
+			"wait_for_available": schema.BoolAttribute{
+				Computed:            true,
+				MarkdownDescription: "Wait for a matching machine to become free when none is available in the pool, instead of failing.  Defaults to false.",
+				Optional:            true,
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"availability_timeout": schema.StringAttribute{
+				MarkdownDescription: "Maximum time to wait for a matching machine to become free when wait_for_available is set.  Time string format, defaults to 30m.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"read_parameters": schema.ListAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "List of parameters to read from the machine into the parameters attribute.",
+				Optional:            true,
+			},
+			"arch": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the architecture of the machine, Machine.Arch field",
+			},
+			"boot_env": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the BootEnv of the machine, Machine.BootEnv field",
+			},
+			"workflow": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the Workflow of the machine, Machine.Workflow field",
+			},
+			"stage": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the Stage of the machine, Machine.Stage field",
+			},
+			"current_task": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the task the machine is running, Machine.Tasks[Machine.CurrentTask]",
+			},
+			"hardware_addrs": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Returns the MAC addresses of the machine, Machine.HardwareAddrs field",
+			},
+			"interfaces": schema.ListNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the network interfaces of the machine from the gohai-inventory parameter",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"name": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Name of the interface",
+						},
+						"mac": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "MAC address of the interface",
+						},
+						"ipv4": schema.ListAttribute{
+							ElementType:         types.StringType,
+							Computed:            true,
+							MarkdownDescription: "IPv4 addresses of the interface",
+						},
+						"ipv6": schema.ListAttribute{
+							ElementType:         types.StringType,
+							Computed:            true,
+							MarkdownDescription: "IPv6 addresses of the interface",
+						},
+					},
+				},
+			},
+			"profiles": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Returns the profiles on the machine, Machine.Profiles field",
+			},
+			"work_order_results": schema.ListNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "Returns the work orders submitted for work_orders and their state",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"uuid": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Uuid of the work order",
+						},
+						"blueprint": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Blueprint run by the work order",
+						},
+						"state": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "State of the work order, e.g. finished or failed",
+						},
+					},
+				},
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"machine_meta": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Returns the Meta of the machine, Machine.Meta field",
+			},
+			"connection_info": connectionInfoAttribute(),
+			"parameters": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Returns the values of the parameters listed in read_parameters.  Values that are not strings are JSON encoded.",
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"filter": schema.ListNestedBlock{
+				MarkdownDescription: "Filter to restrict the search for a machine, added to the filters list.",
+				NestedObject: schema.NestedBlockObject{
+					Attributes: map[string]schema.Attribute{
+						"field": schema.StringAttribute{
+							MarkdownDescription: "Machine field or param to filter on",
+							Required:            true,
+						},
+						"op": schema.StringAttribute{
+							MarkdownDescription: "Digital Rebar filter operator: Eq, Ne, Lt, Lte, Gt, Gte, Re, In, Nin, Between or Except.  Defaults to Eq.",
+							Optional:            true,
+						},
+						"value": schema.StringAttribute{
+							MarkdownDescription: "Value to compare against.  In, Nin and Except take a comma separated list, Between takes lower,upper.",
+							Required:            true,
+						},
+					},
+				},
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+			"timeouts":          timeoutsBlock(),
+			"ready_check":       readyCheckBlock(),
+			"connection_params": connectionParamsBlock(),
 		},
 	}
 }
@@ -206,96 +542,247 @@ func (r *MachineResource) Create(ctx context.Context, req resource.CreateRequest
 	if t := plan.Timeout.ValueString(); t != "" {
 		timeout = t
 	}
-	parms := map[string]interface{}{
-		"pool/wait-timeout": timeout,
-	}
 	plan.Timeout = types.StringValue(timeout)
 
-	pwf := plan.AllocateWorkflow.ValueString()
-	if pwf != "" {
-		parms["pool/workflow"] = pwf
-	}
+	reqCtx := ctx
+	ctx, cancel := context.WithTimeout(reqCtx, plan.operationTimeout("create"))
+	defer cancel()
 
-	profiles := []string{}
-	diags = plan.AddProfiles.ElementsAs(ctx, &profiles, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
-		return
+	if plan.JobLogLines.IsNull() || plan.JobLogLines.IsUnknown() {
+		plan.JobLogLines = types.Int64Value(defaultJobLogLines)
 	}
-	if len(profiles) > 0 {
-		parms["pool/add-profiles"] = profiles
+	setFailureDefaults(&plan)
+	if plan.WaitForAvailable.IsNull() || plan.WaitForAvailable.IsUnknown() {
+		plan.WaitForAvailable = types.BoolValue(false)
 	}
-
-	parameters := map[string]interface{}{}
-	akeys := []string{}
-	diags = plan.AuthorizedKeys.ElementsAs(ctx, &akeys, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
-		return
+	if plan.OnDestroy.IsNull() || plan.OnDestroy.IsUnknown() {
+		plan.OnDestroy = types.StringValue(onDestroyRelease)
 	}
-	if len(akeys) > 0 {
-		accesskeys := map[string]string{}
-		for i, p := range akeys {
-			accesskeys[fmt.Sprintf("terraform-%d", i)] = p
-		}
-		parameters["access-keys"] = accesskeys
+	if plan.Mode.IsNull() || plan.Mode.IsUnknown() {
+		plan.Mode = types.StringValue(modeProvision)
 	}
 
-	aparams := []string{}
-	diags = plan.AddParameters.ElementsAs(ctx, &aparams, false)
+	token := newAllocationToken()
+	parms, diags := r.allocateParms(ctx, &plan, token)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	for _, p := range aparams {
-		param := strings.Split(p, ":")
-		if len(param) < 2 {
-			resp.Diagnostics.AddError("add_parameter format not correct", p)
-			return
-		}
-		key := param[0]
-		value := strings.TrimLeft(param[1], " ")
-		parameters[key] = value
+
+	mc, err := r.allocate(ctx, &plan, pool, parms)
+	if err != nil && plan.WaitForAvailable.ValueBool() && ctx.Err() == nil && r.unavailable(ctx, pool, parms, err) {
+		tflog.Info(ctx, fmt.Sprintf("No machine available in pool %s, waiting: %v", pool, err))
+		cancel()
+		mc, err = r.allocateWhenAvailable(reqCtx, &plan, pool, parms)
+		// The create timeout starts over once a machine is allocated.
+		ctx, cancel = context.WithTimeout(reqCtx, plan.operationTimeout("create"))
+		defer cancel()
 	}
-	if len(parameters) > 0 {
-		parms["pool/add-parameters"] = parameters
+	changes := &machineChanges{}
+	if err != nil {
+		resp.Diagnostics.AddError(fmt.Sprintf("Unable to allocate a machine from pool %s", pool),
+			fmt.Sprintf("%s\n\n%s", err, r.poolReport(ctx, pool, parms)))
+	} else {
+		diags = r.provision(ctx, &plan, mc, changes)
+		resp.Diagnostics.Append(diags...)
+		if !diags.HasError() {
+			mc, diags = r.recoverAllocation(ctx, &plan, parms, mc, changes)
+			resp.Diagnostics.Append(diags...)
+		}
 	}
-	allFilters := []string{"Runnable=Eq(true)", "WorkflowComplete=Eq(true)", "WorkOrderMode=Eq(false)"}
-	filters := []string{}
-	diags = plan.Filters.ElementsAs(ctx, &filters, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
+	if mc == nil {
+		// The server may have allocated a machine before the request failed or was interrupted.
+		machineObject, diags := r.cleanupInterrupted(ctx, &plan, token)
+		resp.Diagnostics.Append(diags...)
+		if machineObject != nil {
+			resp.Diagnostics.Append(r.setMachineAttributes(ctx, &plan, machineObject)...)
+			clearMachineAttributes(&plan)
+			resp.Diagnostics.Append(resp.State.Set(ctx, plan)...)
+		}
 		return
 	}
-	for _, f := range filters {
-		allFilters = append(allFilters, f)
-	}
-	parms["pool/filter"] = allFilters
 
-	pr := []*models.PoolResult{}
-	creq := r.session.Req().Post(parms).UrlFor("pools", pool, "allocateMachines")
-	if err := creq.Do(&pr); err != nil {
-		tflog.Debug(ctx, fmt.Sprintf("POST error %+v | %+v", err, creq))
-		resp.Diagnostics.AddError(fmt.Sprintf("Error allocated from pool %s: %s", pool, err), "")
-		return
-	}
-	mc := pr[0]
 	tflog.Debug(ctx, fmt.Sprintf("Allocated %s machine %s (%s)", mc.Status, mc.Name, mc.Uuid))
 	plan.Status = types.StringValue(string(mc.Status))
 	plan.Name = types.StringValue(mc.Name)
 	plan.Id = types.StringValue(mc.Uuid)
 
-	if mo, err := r.session.GetModel("machines", mc.Uuid); err == nil {
-		machineObject := mo.(*models.Machine)
-		plan.Address = types.StringValue(machineObject.Address.String())
+	if !resp.Diagnostics.HasError() && mc.Status != "HoldBuild" && !plan.reserved() {
+		resp.Diagnostics.Append(r.runWorkOrders(ctx, &plan, changes)...)
+	}
+
+	// The power state can lag the action, so keep the configured value.
+	power := plan.PowerState
+	if !resp.Diagnostics.HasError() {
+		resp.Diagnostics.Append(r.applyPower(ctx, &plan, nil)...)
+	}
+
+	if machineObject, err := r.getMachine(ctx, mc.Uuid); err == nil {
+		resp.Diagnostics.Append(r.setMachineAttributes(ctx, &plan, machineObject)...)
 	} else {
 		tflog.Warn(ctx, fmt.Sprintf("Failed to lookup machine: %v", err))
 	}
+	if !power.IsNull() && !power.IsUnknown() {
+		plan.PowerState = power
+	}
+	clearMachineAttributes(&plan)
+
+	if plan.ReadyCheck != nil && !plan.reserved() && plan.PowerState.ValueString() != powerOff && !resp.Diagnostics.HasError() {
+		if err := plan.ReadyCheck.wait(ctx, plan.Address.ValueString()); err != nil {
+			resp.Diagnostics.AddError(fmt.Sprintf("Machine %s is not ready", mc.Uuid), err.Error())
+		}
+	}
 
+	resp.Diagnostics.Append(saveChanges(ctx, resp.Private, changes)...)
 	diags = resp.State.Set(ctx, plan)
 	resp.Diagnostics.Append(diags...)
 }
 
+/*
+ * Applies the configured params and profiles to a newly allocated
+ * machine and runs the allocate workflow on it.
+ */
+func (r *MachineResource) provision(ctx context.Context, plan *MachineResourceModel, mc *models.PoolResult, changes *machineChanges) diag.Diagnostics {
+	diags := r.applyChanges(ctx, plan, mc.Uuid, changes)
+	if diags.HasError() || plan.reserved() {
+		return diags
+	}
+	pwf, err := r.allocateWorkflow(ctx, plan)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Unable to get the allocate workflow of pool %s", plan.Pool.ValueString()), err.Error())
+		return diags
+	}
+	if pwf == "" {
+		return diags
+	}
+	status, err := r.runWorkflow(ctx, mc.Uuid, pwf)
+	if err != nil {
+		diags.AddError(fmt.Sprintf("Could not run workflow %s on machine %s", pwf, mc.Uuid), err.Error())
+		return diags
+	}
+	mc.Status = status
+	return diags
+}
+
+/*
+ * Returns the workflow to run on allocation: allocate_workflow, or the
+ * allocate workflow of the pool when it is not set.
+ */
+func (r *MachineResource) allocateWorkflow(ctx context.Context, plan *MachineResourceModel) (string, error) {
+	if pwf := plan.AllocateWorkflow.ValueString(); pwf != "" {
+		return pwf, nil
+	}
+	pool := &models.Pool{}
+	if err := r.session.Req().Context(ctx).UrlFor("pools", plan.Pool.ValueString()).Do(pool); err != nil {
+		return "", err
+	}
+	if pool.AllocateActions == nil {
+		return "", nil
+	}
+	return pool.AllocateActions.Workflow, nil
+}
+
+/*
+ * Builds the allocateMachines parameters from the plan.  The token is
+ * recorded on the machine so an interrupted allocation can be found.
+ *
+ * The allocation only claims the machine.  The configured params and
+ * profiles are applied afterwards by provision so the values they
+ * replace can be recorded, then provision runs the allocate workflow.
+ * The pool's own allocate workflow is suppressed on the claim so it
+ * does not start before the params are set.
+ */
+func (r *MachineResource) allocateParms(ctx context.Context, plan *MachineResourceModel, token string) (map[string]interface{}, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	parms := map[string]interface{}{
+		"pool/wait-timeout": waitTimeout(ctx),
+		// An empty workflow keeps the machine's workflow instead of the pool's allocate workflow.
+		"pool/workflow": "",
+	}
+
+	parameters := map[string]interface{}{
+		allocationParam: token,
+	}
+	rec, rdiags := newAllocationRecord(ctx, plan)
+	diags.Append(rdiags...)
+	if diags.HasError() {
+		return nil, diags
+	}
+	parameters[allocationRecordParam] = rec
+	if group := plan.PlacementGroup.ValueString(); group != "" {
+		parameters[placementGroupParam] = group
+	}
+	parms["pool/add-parameters"] = parameters
+	allFilters, fdiags := allocationFilters(ctx, plan)
+	diags.Append(fdiags...)
+	if diags.HasError() {
+		return nil, diags
+	}
+	parms["pool/filter"] = allFilters
+
+	if !plan.Machine.IsNull() && plan.Machine.ValueString() != "" {
+		machine, mdiags := r.resolvePinned(ctx, plan)
+		diags.Append(mdiags...)
+		if diags.HasError() {
+			return nil, diags
+		}
+		parms["pool/machine-list"] = []string{machine.Uuid.String()}
+	}
+	return parms, diags
+}
+
+/*
+ * Allocates a machine from the pool.  Results for machines that were not
+ * allocated are skipped, so an empty or partial result is an error
+ * rather than a panic.
+ *
+ * Machines of a placement group are allocated one at a time, each with
+ * a filter that spreads it away from the rest of the group.
+ */
+func (r *MachineResource) allocate(ctx context.Context, plan *MachineResourceModel, pool string, parms map[string]interface{}) (*models.PoolResult, error) {
+	group, key := plan.PlacementGroup.ValueString(), plan.SpreadBy.ValueString()
+	if _, pinned := parms["pool/machine-list"]; group != "" && key != "" && !pinned {
+		unlock := lockPlacement(group)
+		defer unlock()
+		filters, _ := parms["pool/filter"].([]string)
+		spread, err := r.spreadFilter(ctx, group, key, pool, filters)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s by %s: %w", errPlacement, group, key, err)
+		}
+		if spread != "" {
+			tflog.Debug(ctx, fmt.Sprintf("Spreading placement group %s with filter %s", group, spread))
+			sparms := map[string]interface{}{}
+			for k, v := range parms {
+				sparms[k] = v
+			}
+			sparms["pool/filter"] = append(append([]string{}, filters...), spread)
+			parms = sparms
+		}
+	}
+
+	pr := []*models.PoolResult{}
+	creq := r.session.Req().Context(ctx).Post(parms).UrlFor("pools", pool, "allocateMachines")
+	if err := creq.Do(&pr); err != nil {
+		tflog.Debug(ctx, fmt.Sprintf("POST error %+v | %+v", err, creq))
+		return nil, err
+	}
+	skipped := []string{}
+	for _, mc := range pr {
+		if mc == nil {
+			continue
+		}
+		if mc.Uuid != "" && (mc.Allocated || allocatedStatus(mc.Status)) {
+			return mc, nil
+		}
+		skipped = append(skipped, fmt.Sprintf("%s (%s)", mc.Uuid, mc.Status))
+	}
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("%w: pool %s did not allocate any of the machines it returned: %s", errNoMachine, pool, strings.Join(skipped, ", "))
+	}
+	return nil, fmt.Errorf("%w: pool %s returned no machines", errNoMachine, pool)
+}
+
 func (r *MachineResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
 	tflog.Debug(ctx, "[resourceMachineRead] Reading drp_machine")
 
@@ -307,32 +794,24 @@ func (r *MachineResource) Read(ctx context.Context, req resource.ReadRequest, re
 		return
 	}
 
-	uuid := plan.Id.ValueString()
-	if uuid == "" {
-		tflog.Debug(ctx, "Requires Uuuid from id")
-		resp.Diagnostics.AddError("Requires Uuid from id", "")
-		return
-	}
+	ctx, cancel := context.WithTimeout(ctx, plan.Timeouts.duration("read", defaultTimeout))
+	defer cancel()
 
-	tflog.Debug(ctx, fmt.Sprintf("Reading machine %s", uuid))
-	mo, err := r.session.GetModel("machines", uuid)
-	if err != nil {
-		tflog.Error(ctx, fmt.Sprintf("[resourceMachineRead] Unable to get machine: %s", uuid))
-		resp.Diagnostics.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), "")
+	drift, diags := r.readMachine(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
 		return
 	}
-	machineObject := mo.(*models.Machine)
-	if machineObject.PoolStatus == "HoldBuild" {
-		tflog.Debug(ctx, "Machine: #{uuid} in HoldBuild status. Investigate the cause on the DRP endpoint.")
-		resp.Diagnostics.AddError(fmt.Sprintf("machine %s stuck in HoldBuild status", uuid), "")
+	if drift != "" {
+		tflog.Warn(ctx, fmt.Sprintf("[resourceMachineRead] Removing machine %s from state: %s", plan.Id.ValueString(), drift))
+		resp.Diagnostics.AddWarning(
+			fmt.Sprintf("Machine %s is no longer allocated", plan.Id.ValueString()),
+			fmt.Sprintf("%s. The machine was removed from state and a new allocation will be planned.", drift),
+		)
+		resp.State.RemoveResource(ctx)
 		return
 	}
 
-	plan.Status = types.StringValue(string(machineObject.PoolStatus))
-	plan.Name = types.StringValue(machineObject.Name)
-	plan.Id = types.StringValue(machineObject.Uuid.String())
-	plan.Address = types.StringValue(machineObject.Address.String())
-
 	diags = resp.State.Set(ctx, plan)
 	resp.Diagnostics.Append(diags...)
 }
@@ -340,39 +819,246 @@ func (r *MachineResource) Read(ctx context.Context, req resource.ReadRequest, re
 func (r *MachineResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
 	tflog.Debug(ctx, "[resourceMachineUpdate] Updating drp_machine")
 
-	var plan MachineResourceModel
+	var plan, state MachineResourceModel
 
-	diags := req.State.Get(ctx, &plan)
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	diags = req.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	plan.Id = state.Id
+	if plan.Timeout.IsNull() || plan.Timeout.IsUnknown() {
+		plan.Timeout = state.Timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, plan.operationTimeout("update"))
+	defer cancel()
+
+	if plan.JobLogLines.IsNull() || plan.JobLogLines.IsUnknown() {
+		plan.JobLogLines = types.Int64Value(defaultJobLogLines)
+	}
+	setFailureDefaults(&plan)
+	if plan.WaitForAvailable.IsNull() || plan.WaitForAvailable.IsUnknown() {
+		plan.WaitForAvailable = types.BoolValue(false)
+	}
+	if plan.OnDestroy.IsNull() || plan.OnDestroy.IsUnknown() {
+		plan.OnDestroy = types.StringValue(onDestroyRelease)
+	}
+	if plan.Mode.IsNull() || plan.Mode.IsUnknown() {
+		plan.Mode = types.StringValue(modeProvision)
+	}
+
+	provisioning := state.reserved() && !plan.reserved()
+	if provisioning {
+		resp.Diagnostics.Append(r.provisionReserved(ctx, &plan)...)
+		if resp.Diagnostics.HasError() {
+			// Keep the machine reserved so the next apply runs the workflow again.
+			state.Status = plan.Status
+			resp.State.Set(ctx, state)
+			return
+		}
+		uuid := plan.Id.ValueString()
+		if err := r.updateRecord(ctx, uuid, func(rec *allocationRecord) { rec.Mode = modeProvision }); err != nil {
+			tflog.Warn(ctx, fmt.Sprintf("Failed to record the mode of machine %s: %v", uuid, err))
+		}
+	}
+
+	if state.Status.ValueString() == "HoldBuild" && plan.OnFailure.ValueString() == onFailureRetryWorkflow {
+		mc := &models.PoolResult{
+			Name:   state.Name.ValueString(),
+			Uuid:   state.Id.ValueString(),
+			Status: "HoldBuild",
+		}
+		_, diags = r.recoverAllocation(ctx, &plan, nil, mc, nil)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			resp.State.Set(ctx, state)
+			return
+		}
+	}
+
+	keysChanged := !plan.AuthorizedKeys.Equal(state.AuthorizedKeys)
+	labelsChanged := !plan.Hostname.Equal(state.Hostname) || !plan.Description.Equal(state.Description) || !plan.Meta.Equal(state.Meta)
+	ordersChanged := !plan.reserved() && (provisioning || !plan.WorkOrders.Equal(state.WorkOrders))
+	secretsChanged := !plan.SecureParameters.Equal(state.SecureParameters)
+	if keysChanged || labelsChanged || ordersChanged || secretsChanged {
+		changes, diags := loadChanges(ctx, req.Private)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if keysChanged {
+			resp.Diagnostics.Append(r.updateAccessKeys(ctx, &plan, &state, changes)...)
+		}
+		if secretsChanged && !resp.Diagnostics.HasError() {
+			resp.Diagnostics.Append(r.updateSecureParams(ctx, &plan, &state, changes)...)
+		}
+		if labelsChanged && !resp.Diagnostics.HasError() {
+			resp.Diagnostics.Append(r.updateLabels(ctx, &plan, &state, plan.Id.ValueString(), changes)...)
+		}
+		if ordersChanged && !resp.Diagnostics.HasError() {
+			resp.Diagnostics.Append(r.runWorkOrders(ctx, &plan, changes)...)
+			if len(plan.WorkOrders.Elements()) == 0 && len(state.WorkOrders.Elements()) > 0 && !resp.Diagnostics.HasError() {
+				// No work orders are left to run, take the machine out of work order mode.
+				resp.Diagnostics.Append(r.revertWorkOrderMode(ctx, plan.Id.ValueString(), changes)...)
+			}
+		}
+		if changes != nil {
+			resp.Diagnostics.Append(saveChanges(ctx, resp.Private, changes)...)
+		}
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	power := plan.PowerState
+	resp.Diagnostics.Append(r.applyPower(ctx, &plan, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	drift, diags := r.readMachine(ctx, &plan)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	if drift != "" {
+		resp.Diagnostics.AddError(fmt.Sprintf("Machine %s is no longer allocated", plan.Id.ValueString()), drift)
+		return
+	}
+	if !power.IsNull() && !power.IsUnknown() {
+		plan.PowerState = power
+	}
+
+	if provisioning && plan.ReadyCheck != nil && plan.PowerState.ValueString() != powerOff {
+		// The machine is provisioned now, so record it even when it is not ready.
+		if err := plan.ReadyCheck.wait(ctx, plan.Address.ValueString()); err != nil {
+			resp.Diagnostics.AddError(fmt.Sprintf("Machine %s is not ready", plan.Id.ValueString()), err.Error())
+		}
+	}
+
+	diags = resp.State.Set(ctx, plan)
+	resp.Diagnostics.Append(diags...)
+}
+
+/*
+ * Fetches the machine referenced by the model and refreshes the computed
+ * attributes.  Machines stuck in HoldBuild report the failed job.
+ *
+ * If the machine was deleted, released or moved out of the pool outside
+ * of Terraform, the returned drift describes what was detected.
+ */
+func (r *MachineResource) readMachine(ctx context.Context, plan *MachineResourceModel) (string, diag.Diagnostics) {
+	var diags diag.Diagnostics
 
 	uuid := plan.Id.ValueString()
 	if uuid == "" {
 		tflog.Debug(ctx, "Requires Uuuid from id")
-		resp.Diagnostics.AddError("Requires Uuid from id", "")
-		return
+		diags.AddError("Requires Uuid from id", "")
+		return "", diags
 	}
 
 	tflog.Debug(ctx, fmt.Sprintf("Reading machine %s", uuid))
-	mo, err := r.session.GetModel("machines", uuid)
+	machineObject, err := r.getMachine(ctx, uuid)
 	if err != nil {
+		if isNotFound(err) {
+			return fmt.Sprintf("Machine %s no longer exists on the DRP endpoint", uuid), diags
+		}
 		tflog.Error(ctx, fmt.Sprintf("[resourceMachineRead] Unable to get machine: %s", uuid))
-		resp.Diagnostics.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), "")
-		return
+		diags.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+		return "", diags
+	}
+	if pool := plan.Pool.ValueString(); pool != "" && machineObject.Pool != pool {
+		return fmt.Sprintf("Machine %s moved from pool %s to pool %s", uuid, pool, machineObject.Pool), diags
+	}
+	if !allocatedStatus(machineObject.PoolStatus) {
+		return fmt.Sprintf("Machine %s has pool status %s", uuid, machineObject.PoolStatus), diags
 	}
-	machineObject := mo.(*models.Machine)
 	if machineObject.PoolStatus == "HoldBuild" {
-		tflog.Debug(ctx, "Machine: #{uuid} in HoldBuild status. Investigate the cause on the DRP endpoint.")
-		resp.Diagnostics.AddError(fmt.Sprintf("machine %s stuck in HoldBuild status", uuid), "")
-		return
+		tflog.Debug(ctx, fmt.Sprintf("Machine: %s in HoldBuild status. Investigate the cause on the DRP endpoint.", uuid))
+		lines := defaultJobLogLines
+		if !plan.JobLogLines.IsNull() && !plan.JobLogLines.IsUnknown() {
+			lines = int(plan.JobLogLines.ValueInt64())
+		}
+		if plan.OnFailure.ValueString() == onFailureRetryWorkflow || plan.OnFailure.ValueString() == onFailureReplace {
+			diags.AddWarning(
+				fmt.Sprintf("machine %s stuck in HoldBuild status, the %s policy will be applied on the next apply", uuid, plan.OnFailure.ValueString()),
+				r.holdBuildDetail(ctx, uuid, lines))
+		} else {
+			diags.AddError(fmt.Sprintf("machine %s stuck in HoldBuild status", uuid), r.holdBuildDetail(ctx, uuid, lines))
+			return "", diags
+		}
+	}
+
+	diags.Append(r.setMachineAttributes(ctx, plan, machineObject)...)
+	return "", diags
+}
+
+/*
+ * Fetches a machine by uuid.
+ */
+func (r *MachineResource) getMachine(ctx context.Context, uuid string) (*models.Machine, error) {
+	machine := &models.Machine{}
+	if err := r.session.Req().Context(ctx).UrlFor("machines", uuid).Do(machine); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+/*
+ * Applies the differences between two copies of a machine.
+ */
+func (r *MachineResource) patchMachine(ctx context.Context, old, new *models.Machine) error {
+	res := &models.Machine{}
+	return r.session.Req().Context(ctx).PatchTo(old, new).Do(res)
+}
+
+/*
+ * Returns the timeout for the operation from the timeouts block, falling
+ * back to the timeout attribute.
+ */
+func (m *MachineResourceModel) operationTimeout(op string) time.Duration {
+	def := defaultTimeout
+	if d, err := time.ParseDuration(m.Timeout.ValueString()); err == nil {
+		def = d
+	}
+	return m.Timeouts.duration(op, def)
+}
+
+/*
+ * Pool statuses of a machine that is still allocated from its pool.
+ */
+func allocatedStatus(status models.PoolStatus) bool {
+	switch status {
+	case "InUse", "Building", "HoldBuild":
+		return true
+	}
+	return false
+}
+
+/*
+ * Pool statuses of a machine that was released from its pool.  Pools
+ * with release actions may hand the machine on to another pool.
+ */
+func releasedStatus(status models.PoolStatus) bool {
+	switch status {
+	case "Free", "Joining", "Leaving":
+		return true
 	}
+	return false
+}
 
-	plan.Status = types.StringValue(string(machineObject.PoolStatus))
-	plan.Name = types.StringValue(machineObject.Name)
-	plan.Id = types.StringValue(machineObject.Uuid.String())
-	plan.Address = types.StringValue(machineObject.Address.String())
+/*
+ * Reports if an API error is a 404 from the DRP endpoint.
+ */
+func isNotFound(err error) bool {
+	if e, ok := err.(*models.Error); ok {
+		return e.Code == http.StatusNotFound
+	}
+	return false
 }
 
 func (r *MachineResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
@@ -402,111 +1088,252 @@ func (r *MachineResource) Delete(ctx context.Context, req resource.DeleteRequest
 	if t := plan.Timeout.ValueString(); t != "" {
 		timeout = t
 	}
-	parms := map[string]interface{}{
-		"pool/wait-timeout": timeout,
-		"pool/machine-list": []string{uuid},
-	}
 	plan.Timeout = types.StringValue(timeout)
 
-	pwf := plan.DeallocateWorkflow.ValueString()
-	if pwf != "" {
-		parms["pool/workflow"] = pwf
+	if plan.OnDestroy.ValueString() == onDestroyRetain {
+		tflog.Info(ctx, fmt.Sprintf("Retaining machine %s in pool %s", uuid, pool))
+		return
 	}
 
-	profiles := []string{}
-	diags = plan.AddProfiles.ElementsAs(ctx, &profiles, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
+	ctx, cancel := context.WithTimeout(ctx, plan.operationTimeout("delete"))
+	defer cancel()
+
+	machineObject, err := r.getMachine(ctx, uuid)
+	if err != nil {
+		if isNotFound(err) {
+			resp.Diagnostics.AddWarning(fmt.Sprintf("Machine %s no longer exists", uuid), "There is nothing to release, the machine was removed from state.")
+			return
+		}
+		resp.Diagnostics.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
 		return
 	}
-	if len(profiles) > 0 {
-		parms["pool/remove-profiles"] = profiles
+	if machineObject.Pool != pool || !allocatedStatus(machineObject.PoolStatus) {
+		resp.Diagnostics.AddWarning(fmt.Sprintf("Machine %s is already released", uuid),
+			fmt.Sprintf("The machine has pool status %s in pool %s, so it was removed from state without releasing it.", machineObject.PoolStatus, machineObject.Pool))
+		return
 	}
 
-	parameters := []string{}
-	akeys := []string{}
-	diags = plan.AuthorizedKeys.ElementsAs(ctx, &akeys, false)
+	if plan.OnDestroy.ValueString() == onDestroyWipe {
+		if err := r.wipeMachine(ctx, machineObject, plan.WipeWorkflow.ValueString()); err != nil {
+			resp.Diagnostics.AddError(fmt.Sprintf("Could not wipe %s, it was not released", uuid), err.Error())
+			return
+		}
+	}
+
+	changes, diags := loadChanges(ctx, req.Private)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	if len(akeys) > 0 {
-		parameters = append(parameters, "access-keys")
+	resp.Diagnostics.Append(r.undoAccessKeys(ctx, &plan, uuid, changes)...)
+	resp.Diagnostics.Append(r.revertLabels(ctx, uuid, changes)...)
+	resp.Diagnostics.Append(r.revertWorkOrderMode(ctx, uuid, changes)...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-
-	aparams := []string{}
-	diags = plan.AddParameters.ElementsAs(ctx, &aparams, false)
+	parms, diags := r.releaseParms(ctx, &plan, uuid, changes)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	for _, p := range aparams {
-		param := strings.Split(p, ":")
-		if len(param) < 2 {
-			resp.Diagnostics.AddError("add_parameter format not correct", p)
+
+	pr, err := r.release(ctx, pool, parms)
+	if err != nil {
+		resp.Diagnostics.AddError(fmt.Sprintf("Error releasing %s from pool %s: %s", uuid, pool, err), "")
+		return
+	}
+
+	status, found := releaseStatus(pr, uuid)
+	if !found {
+		// The pool did not report on the machine, so check it directly.
+		m, err := r.getMachine(ctx, uuid)
+		switch {
+		case isNotFound(err):
+			return
+		case err != nil:
+			resp.Diagnostics.AddError(fmt.Sprintf("Unable to get machine: %s", uuid), err.Error())
+			return
+		case m.Pool != pool:
 			return
 		}
-		key := param[0]
-		parameters = append(parameters, key)
+		status = m.PoolStatus
 	}
-	if len(parameters) > 0 {
-		parms["pool/remove-parameters"] = parameters
+	if !releasedStatus(status) {
+		resp.Diagnostics.AddError(fmt.Sprintf("Could not release %s from pool %s", uuid, pool),
+			fmt.Sprintf("The machine has pool status %s.", status))
+		return
 	}
 
-	profiles = []string{}
-	diags = plan.DeallocateProfiles.ElementsAs(ctx, &profiles, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
+	if plan.OnDestroy.ValueString() == onDestroyDeregister {
+		if err := r.deregisterMachine(ctx, uuid); err != nil {
+			resp.Diagnostics.AddError(fmt.Sprintf("Released %s but could not delete it", uuid), err.Error())
+		}
 		return
 	}
-	if len(profiles) > 0 {
-		parms["pool/add-profiles"] = profiles
+
+	if qp := plan.QuarantinePool.ValueString(); qp != "" && machineObject.PoolStatus == "HoldBuild" {
+		if err := r.quarantine(ctx, uuid, pool, qp); err != nil {
+			summary := fmt.Sprintf("Could not quarantine %s in pool %s", uuid, qp)
+			if plan.OnFailure.ValueString() == onFailureReplace {
+				// The replacement could be allocated the same failed machine.
+				resp.Diagnostics.AddError(summary, err.Error())
+				return
+			}
+			resp.Diagnostics.AddWarning(summary, err.Error())
+		}
+	}
+}
+
+/*
+ * Finds the status of the machine in the releaseMachines results.
+ */
+func releaseStatus(pr []*models.PoolResult, uuid string) (models.PoolStatus, bool) {
+	for _, mc := range pr {
+		if mc != nil && mc.Uuid == uuid {
+			return mc.Status, true
+		}
+	}
+	return "", false
+}
+
+/*
+ * Builds the releaseMachines parameters for the machine from the plan.
+ * When the changes made to the machine were recorded only those are
+ * undone, otherwise every configured param and profile is removed.
+ */
+func (r *MachineResource) releaseParms(ctx context.Context, plan *MachineResourceModel, uuid string, changes *machineChanges) (map[string]interface{}, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	parms := map[string]interface{}{
+		"pool/wait-timeout": waitTimeout(ctx),
+		"pool/machine-list": []string{uuid},
+	}
+
+	pwf := plan.DeallocateWorkflow.ValueString()
+	if pwf != "" {
+		parms["pool/workflow"] = pwf
 	}
 
 	params := map[string]interface{}{}
-	aparams = []string{}
-	diags = plan.DeallocateParameters.ElementsAs(ctx, &aparams, false)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
-		return
+	aparams := []string{}
+	diags.Append(plan.DeallocateParameters.ElementsAs(ctx, &aparams, false)...)
+	if diags.HasError() {
+		return nil, diags
 	}
 	for _, p := range aparams {
 		param := strings.Split(p, ":")
 		if len(param) < 2 {
-			resp.Diagnostics.AddError("deallocate_parameter format not correct", p)
-			return
+			diags.AddError("deallocate_parameter format not correct", p)
+			return nil, diags
 		}
 		key := param[0]
 		value := strings.TrimLeft(param[1], " ")
 		params[key] = value
 	}
-	if len(params) > 0 {
-		parms["pool/add-parameters"] = params
+
+	parameters := []string{allocationParam, allocationRecordParam, placementGroupParam}
+	if changes != nil && !changes.Untracked {
+		changes.releaseParms(parms, parameters, params)
+	} else {
+		added, profiles, adiags := additions(ctx, plan)
+		diags.Append(adiags...)
+		if diags.HasError() {
+			return nil, diags
+		}
+		if len(profiles) > 0 {
+			parms["pool/remove-profiles"] = profiles
+		}
+		for key := range added {
+			parameters = append(parameters, key)
+		}
+		secure, sdiags := secureAdditions(ctx, plan)
+		diags.Append(sdiags...)
+		if diags.HasError() {
+			return nil, diags
+		}
+		for key := range secure {
+			parameters = append(parameters, key)
+		}
+		parms["pool/remove-parameters"] = parameters
+		if len(params) > 0 {
+			parms["pool/add-parameters"] = params
+		}
+	}
+
+	profiles := []string{}
+	diags.Append(plan.DeallocateProfiles.ElementsAs(ctx, &profiles, false)...)
+	if diags.HasError() {
+		return nil, diags
 	}
+	if len(profiles) > 0 {
+		parms["pool/add-profiles"] = profiles
+	}
+	return parms, diags
+}
 
+/*
+ * Releases machines back to the pool.
+ */
+func (r *MachineResource) release(ctx context.Context, pool string, parms map[string]interface{}) ([]*models.PoolResult, error) {
 	pr := []*models.PoolResult{}
-	creq := r.session.Req().Post(parms).UrlFor("pools", pool, "releaseMachines")
+	creq := r.session.Req().Context(ctx).Post(parms).UrlFor("pools", pool, "releaseMachines")
 	if err := creq.Do(&pr); err != nil {
 		tflog.Error(ctx, fmt.Sprintf("[resourceMachineDelete] POST error %+v | %+v", err, creq))
-		resp.Diagnostics.AddError(fmt.Sprintf("Error releasing %s from pool %s: %s", uuid, pool, err), "")
+		return nil, err
+	}
+	return pr, nil
+}
+
+/*
+ * Validates the objects referenced by the plan and plans the on_failure
+ * policy for machines that landed in HoldBuild.
+ */
+func (r *MachineResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.Plan.Raw.IsNull() {
 		return
 	}
 
-	mc := pr[0]
-	if mc.Status == "Free" {
-		plan.Status = types.StringValue(string(mc.Status))
-		plan.Name = types.StringValue(uuid)
-		plan.Id = types.StringValue("")
-		plan.Address = types.StringValue("")
+	var plan MachineResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if req.State.Raw.IsNull() {
+		resp.Diagnostics.Append(r.validatePlan(ctx, &plan, nil)...)
+		return
+	}
 
-		diags = resp.State.Set(ctx, plan)
-		resp.Diagnostics.Append(diags...)
-	} else {
-		resp.Diagnostics.AddError(fmt.Sprintf("Could not release %s from pool %s", uuid, pool), "")
+	var state MachineResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	resp.Diagnostics.Append(r.validatePlan(ctx, &plan, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if !plan.reserved() && state.reserved() {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("status"), types.StringUnknown())...)
+	}
+	if plan.reserved() && !state.reserved() {
+		resp.RequiresReplace = append(resp.RequiresReplace, path.Root("mode"))
+	}
+	if !plan.reserved() && (state.reserved() || !plan.WorkOrders.Equal(state.WorkOrders)) {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("work_order_results"), types.ListUnknown(workOrderResultType))...)
+	}
+	if state.Status.ValueString() != "HoldBuild" {
 		return
 	}
-}
 
-func (r *MachineResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
-	resource.ImportStatePassthroughID(ctx, path.Root("id"), req, resp)
+	policy := plan.OnFailure.ValueString()
+	if plan.OnFailure.IsUnknown() {
+		policy = state.OnFailure.ValueString()
+	}
+	switch policy {
+	case onFailureRetryWorkflow:
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("status"), types.StringUnknown())...)
+	case onFailureReplace:
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("status"), types.StringUnknown())...)
+		resp.RequiresReplace = append(resp.RequiresReplace, path.Root("status"))
+	}
 }
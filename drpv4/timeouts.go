@@ -0,0 +1,115 @@
+package drpv4
+
+/*
+ * Copyright RackN 2023
+ */
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// defaultTimeout is used for operations without a configured timeout
+const defaultTimeout = 5 * time.Minute
+
+// TimeoutsModel describes the timeouts block.
+type TimeoutsModel struct {
+	Create types.String `tfsdk:"create"`
+	Read   types.String `tfsdk:"read"`
+	Update types.String `tfsdk:"update"`
+	Delete types.String `tfsdk:"delete"`
+}
+
+/*
+ * Builds the standard timeouts { create, read, update, delete } block.
+ */
+func timeoutsBlock() schema.Block {
+	attribute := func(op string) schema.StringAttribute {
+		return schema.StringAttribute{
+			MarkdownDescription: fmt.Sprintf("Maximum time to wait for the %s operation.  Time string format.", op),
+			Optional:            true,
+			Validators: []validator.String{
+				durationValidator{},
+			},
+		}
+	}
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "Per-operation timeouts.",
+		Attributes: map[string]schema.Attribute{
+			"create": attribute("create"),
+			"read":   attribute("read"),
+			"update": attribute("update"),
+			"delete": attribute("delete"),
+		},
+	}
+}
+
+/*
+ * Returns the timeout for the operation, falling back to the given
+ * default when the block or the operation is not configured.
+ */
+func (t *TimeoutsModel) duration(op string, def time.Duration) time.Duration {
+	if t == nil {
+		return def
+	}
+	var v types.String
+	switch op {
+	case "create":
+		v = t.Create
+	case "read":
+		v = t.Read
+	case "update":
+		v = t.Update
+	case "delete":
+		v = t.Delete
+	}
+	if v.IsNull() || v.IsUnknown() {
+		return def
+	}
+	d, err := time.ParseDuration(v.ValueString())
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+/*
+ * Returns the time left before the context deadline in the time string
+ * format used by pool/wait-timeout.
+ */
+func waitTimeout(ctx context.Context) string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return defaultTimeout.String()
+	}
+	left := time.Until(deadline).Round(time.Second)
+	if left < time.Second {
+		left = time.Second
+	}
+	return left.String()
+}
+
+// durationValidator checks that a string is in time string format
+type durationValidator struct{}
+
+func (v durationValidator) Description(ctx context.Context) string {
+	return "value must be a time string, e.g. 30s, 5m or 2h"
+}
+
+func (v durationValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v durationValidator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+	if _, err := time.ParseDuration(req.ConfigValue.ValueString()); err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid time string", fmt.Sprintf("%s: %s", v.Description(ctx), err))
+	}
+}
@@ -26,13 +26,74 @@ resource "drp_machine" "one_random_node" {
 
   # Settable values
   # pool = name of an existing DRP pool (defaults to "default")
+  # machine = name or uuid of the exact machine to allocate from the pool
   # allocate_workflow = Name of workflow to set when a machine is allocated from the pool
-  # if none is set the default pool/workflow defined by the drp admin will be used
+  # if none is set the allocate workflow of the pool defined by the drp admin is run by the provider
+  # after params, profiles and keys are set, the pool does not start it on its own
   # deallocate_workflow = Name of workflow to set when the machine is released back to the pool
   # setting this overrides the defaults defined by the DRP admin
-  # timeout = time string for max wait time (default to 5m)
+  # timeout = time string for max wait time (default to 5m), deprecated in favor of the timeouts block
   #
-  # List of public SSH keys to be installed (written as Param.access-keys)
+  # Per-operation time strings for max wait time, changing them never replaces the machine
+  # timeouts {
+  #   create = "120m"
+  #   read   = "5m"
+  #   update = "30m"
+  #   delete = "30m"
+  # }
+  #
+  # Wait until the machine accepts connections before create completes
+  # ready_check {
+  #   port     = 22
+  #   protocol = "tcp"
+  #   timeout  = "10m"
+  #   banner   = "SSH-2.0"
+  # }
+  #
+  # Params connection_info is read from, e.g. for connection blocks:
+  # host = drp_machine.one_random_node.connection_info.host, user = drp_machine.one_random_node.connection_info.user
+  # connection_params {
+  #   user     = "provisioner-default-user"
+  #   port     = "ssh-port"
+  #   bastion  = "bastion-host"
+  #   host_key = "ssh-host-key"
+  # }
+  #
+  # Claim the machine without running allocate_workflow until mode is switched to "provision"
+  # mode = "reserve"
+  #
+  # Queue for a machine instead of failing when none is free in the pool
+  # wait_for_available = true
+  # availability_timeout = "2h"
+  #
+  # What to do when the machine lands in HoldBuild (default "error")
+  # on_failure = "retry_workflow" restarts the allocate workflow, "replace" allocates a different machine
+  # failure_retries = 2
+  # quarantine_pool = "broken" moves machines released by "replace" out of the pool, required with "replace"
+  #
+  # What to do with the machine on destroy (default "release")
+  # on_destroy = "wipe" runs wipe_workflow before release, "deregister" deletes the machine, "retain" leaves it allocated
+  # wipe_workflow = "erase-hard-disks-for-os-install"
+  #
+  # Spread the machines of a cluster across racks
+  # placement_group = "etcd"
+  # spread_by = "rack"
+  #
+  # Name, description and Meta labels set after allocation and restored on release
+  # hostname = "web-01"
+  # description = "web tier"
+  # meta = { "team" = "web" }
+  #
+  # Blueprints run as work orders once the machine is allocated
+  # work_orders = [
+  #   { blueprint = "utility-update-firmware", params = { "flash/force" = "true" } },
+  # ]
+  #
+  # Power the machine through its IPMI or Redfish plugin, change the trigger to power cycle it
+  # power_state = "off"
+  # power_cycle_trigger = "bios-2023-06"
+  #
+  # List of public SSH keys to be installed (merged into Param.access-keys, can be changed in place)
   # authorized_keys = ["ssh key"]
   #
   # List of profiles to apply to node (must already exist)
@@ -41,6 +102,10 @@ resource "drp_machine" "one_random_node" {
   # list of parameters to set with their string value forms
   # add_parameters = ["param1: value1", "param2: value2"]
   #
+  # secure parameters, encrypted for the machine before they are set
+  # changes are applied in place, an imported machine has them set again on the first apply
+  # secure_parameters = { "my-api-key" = var.api_key }
+  #
   # Use filters to hone your machine to a specific set of criteria, or exclude them based on criteria
   # follows the Digital Rebar CLI command line pattern
   # This example looks for a machine named esxi-7-testing.example.local where the "Address" field on the
@@ -48,6 +113,16 @@ resource "drp_machine" "one_random_node" {
   # filters = ["Name=esxi-7-testing.example.local", "Address=Ne()"]
   # This example excludes machines that do not have an Address
   # filters = ["Address=Ne()"]
+  #
+  # Filters can also be written as blocks, which are checked at plan time
+  # filter {
+  #   field = "Arch"
+  #   op    = "Eq"
+  #   value = "amd64"
+  # }
+  #
+  # Replace the default Runnable/WorkflowComplete/WorkOrderMode filters, e.g. to include machines still in a workflow
+  # default_filters = ["Runnable=Eq(true)"]
   # Returned values
   # name = machine name
   # address = machine address
@@ -0,0 +1,4 @@
+# Machines can be imported by uuid, by name or by pool and uuid
+terraform import drp_machine.one_random_node 3f2504e0-4f89-11d3-9a0c-0305e82c3301
+terraform import drp_machine.one_random_node Name:d52-54-00-12-34-56.example.local
+terraform import drp_machine.one_random_node k8s_pool/3f2504e0-4f89-11d3-9a0c-0305e82c3301